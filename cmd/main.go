@@ -1,26 +1,69 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"github.com/asavt7/antibot-developer-trainee/pkg/authz"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
 	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
 	"github.com/asavt7/antibot-developer-trainee/pkg/server"
 	"github.com/asavt7/antibot-developer-trainee/pkg/service"
 	"github.com/asavt7/antibot-developer-trainee/pkg/store"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	conf := configs.NewConfigs()
 
-	inMemStore := store.NewInMemoryStoreRateLimitStore(conf)
-	inMemStore.InitStore()
+	rateLimitStore, closeStore, err := store.NewRateLimitStore(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeStore()
 
-	rateLimitService := service.NewServiceImpl(conf, inMemStore)
+	rateLimitService := service.NewServiceImpl(conf, rateLimitStore, clock.New())
+
+	var authzServ *authz.Server
+	if conf.GrpcPort != 0 {
+		authzServ = authz.NewServer(conf, rateLimitService)
+		go func() {
+			// returns nil once stopped
+			if err := authzServ.RunServer(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	serv := server.NewServer(conf, rateLimitService, http.FileServer(http.Dir("./static")))
 
-	err := serv.RunServer()
-	if err != nil {
+	// shutting down gracefully lets the deferred closeStore save the store snapshot
+	// once the checks in flight of both servers are finished
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		sig := <-stop
+		log.Printf("Shutting down on %s", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := serv.Shutdown(ctx); err != nil {
+			log.Printf("shutting down server: %v", err)
+		}
+		if authzServ != nil {
+			authzServ.Stop()
+		}
+	}()
+
+	err = serv.RunServer()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+	// Shutdown returns once the requests in flight are finished
+	<-shutdown
 }
@@ -0,0 +1,112 @@
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/middleware"
+	"github.com/asavt7/antibot-developer-trainee/pkg/service"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Server implements envoy.service.auth.v3.Authorization, so that Envoy can consult the rate limiter
+// with the ext_authz filter.
+type Server struct {
+	authv3.UnimplementedAuthorizationServer
+	grpcServer *grpc.Server
+	service    *service.Service
+	addr       string
+}
+
+func NewServer(config configs.Config, service *service.Service) *Server {
+	s := &Server{
+		grpcServer: grpc.NewServer(),
+		service:    service,
+		addr:       fmt.Sprintf(":%d", config.GrpcPort),
+	}
+	authv3.RegisterAuthorizationServer(s.grpcServer, s)
+	return s
+}
+
+func (s *Server) RunServer() error {
+	log.Printf("Starting ext_authz grpc server at %s", s.addr)
+	lis, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
+
+func (s *Server) Serve(lis net.Listener) error {
+	return s.grpcServer.Serve(lis)
+}
+
+func (s *Server) Stop() {
+	s.grpcServer.GracefulStop()
+}
+
+// Check limits requests by the downstream address from the request attributes, ips of the deny list are forbidden.
+func (s *Server) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	address := req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress()
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return deniedResponse(codes.InvalidArgument, typev3.StatusCode_BadRequest,
+			fmt.Sprintf("invalid downstream address %q", address), nil), nil
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+
+	isBlocked, quota, err := s.service.IsLimitExceededForIp(ip)
+	if errors.Is(err, service.ErrDenied) {
+		return deniedResponse(codes.PermissionDenied, typev3.StatusCode_Forbidden, "Forbidden", nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	middleware.SetRateLimitHeaders(header, quota, isBlocked, s.service.Clock.Now())
+	headers := headerValueOptions(header)
+	if isBlocked {
+		return deniedResponse(codes.ResourceExhausted, typev3.StatusCode_TooManyRequests, "Too Many Requests", headers), nil
+	}
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{ResponseHeadersToAdd: headers},
+		},
+	}, nil
+}
+
+func deniedResponse(code codes.Code, httpCode typev3.StatusCode, body string, headers []*corev3.HeaderValueOption) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(code), Message: body},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: httpCode},
+				Headers: headers,
+				Body:    body,
+			},
+		},
+	}
+}
+
+func headerValueOptions(header http.Header) []*corev3.HeaderValueOption {
+	options := make([]*corev3.HeaderValueOption, 0, len(header))
+	for key := range header {
+		options = append(options, &corev3.HeaderValueOption{
+			Header: &corev3.HeaderValue{Key: key, Value: header.Get(key)},
+		})
+	}
+	return options
+}
@@ -0,0 +1,167 @@
+package authz_test
+
+import (
+	"context"
+	"errors"
+	"github.com/asavt7/antibot-developer-trainee/pkg/authz"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/mocks"
+	"github.com/asavt7/antibot-developer-trainee/pkg/service"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	mockRateLimitService = &mocks.RateLimitCheckerMockService{}
+	mockService          = &service.Service{RateLimitChecker: mockRateLimitService, Clock: clock.New()}
+)
+
+func initClient(t *testing.T) authv3.AuthorizationClient {
+	lis := bufconn.Listen(1024 * 1024)
+	serv := authz.NewServer(configs.Config{}, mockService)
+	go serv.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		serv.Stop()
+	})
+	return authv3.NewAuthorizationClient(conn)
+}
+
+func checkRequest(address string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address: &corev3.Address{
+					Address: &corev3.Address_SocketAddress{
+						SocketAddress: &corev3.SocketAddress{
+							Address:       address,
+							PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 51234},
+						},
+					},
+				},
+			},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{Method: "GET", Path: "/"},
+			},
+		},
+	}
+}
+
+func headerValue(headers []*corev3.HeaderValueOption, key string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.GetHeader().GetKey(), key) {
+			return h.GetHeader().GetValue()
+		}
+	}
+	return ""
+}
+
+func TestServer_Check(t *testing.T) {
+	client := initClient(t)
+
+	t.Run("allowed", func(t *testing.T) {
+		var ipArg net.IP
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			ipArg = ip
+			return false, store.Quota{Limit: 10, Remaining: 4, ResetAt: time.Now().Add(3 * time.Second)}, nil
+		}
+
+		res, err := client.Check(context.Background(), checkRequest("111.111.111.111"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetStatus().GetCode() != int32(codes.OK) {
+			t.Errorf("expected OK status, actual %v", res.GetStatus())
+		}
+		if !ipArg.Equal(net.ParseIP("111.111.111.111")) {
+			t.Errorf("expected downstream address passed to service, actual %s", ipArg)
+		}
+		headers := res.GetOkResponse().GetResponseHeadersToAdd()
+		if v := headerValue(headers, "RateLimit-Remaining"); v != "4" {
+			t.Errorf("expected RateLimit-Remaining 4, actual %q", v)
+		}
+		if v := headerValue(headers, "RateLimit-Reset"); v != "3" {
+			t.Errorf("expected RateLimit-Reset 3, actual %q", v)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return true, store.Quota{Limit: 10, BlockedUntil: time.Now().Add(20 * time.Second)}, nil
+		}
+
+		res, err := client.Check(context.Background(), checkRequest("2001:db8::1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetStatus().GetCode() != int32(codes.ResourceExhausted) {
+			t.Errorf("expected RESOURCE_EXHAUSTED status, actual %v", res.GetStatus())
+		}
+		denied := res.GetDeniedResponse()
+		if denied.GetStatus().GetCode() != typev3.StatusCode_TooManyRequests {
+			t.Errorf("expected http status 429, actual %v", denied.GetStatus())
+		}
+		if v := headerValue(denied.GetHeaders(), "Retry-After"); v != "20" {
+			t.Errorf("expected Retry-After 20, actual %q", v)
+		}
+	})
+
+	t.Run("denied by access list", func(t *testing.T) {
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return false, store.Quota{}, service.ErrDenied
+		}
+
+		res, err := client.Check(context.Background(), checkRequest("203.0.113.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetStatus().GetCode() != int32(codes.PermissionDenied) {
+			t.Errorf("expected PERMISSION_DENIED status, actual %v", res.GetStatus())
+		}
+		if code := res.GetDeniedResponse().GetStatus().GetCode(); code != typev3.StatusCode_Forbidden {
+			t.Errorf("expected http status 403, actual %v", code)
+		}
+	})
+
+	t.Run("invalid downstream address", func(t *testing.T) {
+		res, err := client.Check(context.Background(), checkRequest("qwe"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetDeniedResponse().GetStatus().GetCode() != typev3.StatusCode_BadRequest {
+			t.Errorf("expected http status 400, actual %v", res.GetDeniedResponse().GetStatus())
+		}
+	})
+
+	t.Run("error from service layer", func(t *testing.T) {
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return false, store.Quota{}, errors.New("error")
+		}
+
+		_, err := client.Check(context.Background(), checkRequest("111.111.111.111"))
+		if err == nil {
+			t.Errorf("expected grpc error")
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package clock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	t.Run("advance", func(t *testing.T) {
+		clk := NewFake(start)
+		clk.Advance(time.Second)
+		if now := clk.Now(); !now.Equal(start.Add(time.Second)) {
+			t.Errorf("expected %s, actual %s", start.Add(time.Second), now)
+		}
+	})
+
+	t.Run("timers fire in order of deadlines", func(t *testing.T) {
+		clk := NewFake(start)
+		var fired []string
+		var firedAt []time.Duration
+		record := func(name string) func() {
+			return func() {
+				fired = append(fired, name)
+				firedAt = append(firedAt, clk.Now().Sub(start))
+			}
+		}
+		clk.AfterFunc(3*time.Second, record("third"))
+		clk.AfterFunc(time.Second, record("first"))
+		clk.AfterFunc(2*time.Second, record("second"))
+		clk.AfterFunc(5*time.Second, record("later"))
+
+		clk.Advance(3 * time.Second)
+		if expected := []string{"first", "second", "third"}; !reflect.DeepEqual(fired, expected) {
+			t.Errorf("expected %v fired, actual %v", expected, fired)
+		}
+		if expected := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}; !reflect.DeepEqual(firedAt, expected) {
+			t.Errorf("expected fired at %v, actual %v", expected, firedAt)
+		}
+		if n := clk.Pending(); n != 1 {
+			t.Errorf("expected 1 pending timer, actual %d", n)
+		}
+	})
+
+	t.Run("timer set by callback", func(t *testing.T) {
+		clk := NewFake(start)
+		fired := 0
+		clk.AfterFunc(time.Second, func() {
+			clk.AfterFunc(time.Second, func() {
+				fired++
+			})
+		})
+		clk.Advance(2 * time.Second)
+		if fired != 1 {
+			t.Errorf("expected timer set by callback fired within the same advance")
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		clk := NewFake(start)
+		timer := clk.AfterFunc(time.Second, func() {
+			t.Errorf("expected stopped timer not to fire")
+		})
+		if !timer.Stop() {
+			t.Errorf("expected pending timer stopped")
+		}
+		if timer.Stop() {
+			t.Errorf("expected second stop to report false")
+		}
+		clk.Advance(2 * time.Second)
+	})
+}
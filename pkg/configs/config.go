@@ -2,33 +2,112 @@ package configs
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
-var (
-	port            int
-	prefixSize      int
-	requestLimit    int
-	interval        time.Duration
-	blockingTimeout time.Duration
+const (
+	StoreMemory = "memory"
+	StoreRedis  = "redis"
+	StoreBolt   = "bolt"
 )
 
-func init() {
-	const (
-		defaultPort            = 8080
-		defaultPrefixSize      = 24
-		defaultRequestLimit    = 10
-		defaultTimeLimit       = 10 * time.Second
-		defaultBlockingTimeout = 100 * time.Second
-	)
-	flag.IntVar(&port, "port", lookupEnvOrInt("PORT", defaultPort), "port number")
-	flag.IntVar(&prefixSize, "length", lookupEnvOrInt("LENGTH", defaultPrefixSize), "subnet prefix length [0..32]")
-	flag.IntVar(&requestLimit, "limit", lookupEnvOrInt("LIMIT", defaultRequestLimit), "maximum number of requests per interval ${interval}")
-	flag.DurationVar(&interval, "interval", lookupEnvOrDuration("INTERVAL", defaultTimeLimit), "interval")
-	flag.DurationVar(&blockingTimeout, "blocking_timeout", lookupEnvOrDuration("BLOCKING_TIMEOUT", defaultBlockingTimeout), "resource blocking time if request quota is exceeded")
+// rate limiting algorithms
+const (
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmSlidingLog    = "sliding_log"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmGCRA          = "gcra"
+)
+
+// client ip sources
+const (
+	IpSourceForwarded     = "forwarded"
+	IpSourceXForwardedFor = "x-forwarded-for"
+	IpSourceXRealIp       = "x-real-ip"
+	IpSourceRemoteAddr    = "remote-addr"
+
+	DefaultIpSources = IpSourceXForwardedFor + "," + IpSourceRemoteAddr
+)
+
+// DefaultTrustedProxies are loopback and private networks, where the reverse proxies usually run.
+const DefaultTrustedProxies = "127.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,::1/128,fc00::/7"
+
+// defaults of the flags
+const (
+	defaultPort            = 8080
+	defaultPrefixSize      = 24
+	defaultPrefixSizeV6    = 64
+	defaultRequestLimit    = 10
+	defaultTimeLimit       = 10 * time.Second
+	defaultBlockingTimeout = 100 * time.Second
+	defaultRedisAddr       = "localhost:6379"
+	defaultBoltPath        = "antibot.db"
+	defaultMaxSubnets      = 1000000
+	defaultSnapshotEvery   = time.Minute
+	defaultServerTimeout   = 10 * time.Second
+)
+
+// flagValues are the flags converted before they are set to Config
+type flagValues struct {
+	trustedProxies string
+	ipSources      string
+	allowList      string
+	allowListFile  string
+	denyList       string
+	denyListFile   string
+}
+
+// registerFlags defines the flags of Config in flags, the flags default to the environment variables.
+func registerFlags(flags *flag.FlagSet) (*Config, *flagValues) {
+	c, v := &Config{}, &flagValues{}
+	flags.IntVar(&c.Port, "port", lookupEnvOrInt("PORT", defaultPort), "port number")
+	flags.IntVar(&c.PrefixSize, "length", lookupEnvOrInt("LENGTH", defaultPrefixSize), "subnet prefix length [0..32]")
+	flags.IntVar(&c.PrefixSizeV6, "length_v6", lookupEnvOrInt("LENGTH_V6", defaultPrefixSizeV6), "IPv6 subnet prefix length [0..128]")
+	flags.IntVar(&c.RequestLimit, "limit", lookupEnvOrInt("LIMIT", defaultRequestLimit), "maximum number of requests per interval ${interval}")
+	flags.DurationVar(&c.TimeInterval, "interval", lookupEnvOrDuration("INTERVAL", defaultTimeLimit), "interval")
+	flags.DurationVar(&c.BlockingTimeout, "blocking_timeout", lookupEnvOrDuration("BLOCKING_TIMEOUT", defaultBlockingTimeout), "resource blocking time if request quota is exceeded")
+	flags.StringVar(&c.Store, "store", lookupEnvOrString("STORE", StoreMemory), "rate limit store type [memory|redis|bolt]")
+	flags.StringVar(&c.Algorithm, "algorithm", lookupEnvOrString("ALGORITHM", AlgorithmFixedWindow), "rate limiting algorithm, redis store supports fixed_window only [fixed_window|token_bucket|sliding_log|sliding_window|gcra]")
+	flags.IntVar(&c.Burst, "burst", lookupEnvOrInt("BURST", 0), "burst size of token_bucket and gcra algorithms, request limit is used if 0")
+	flags.IntVar(&c.MaxSubnets, "max_subnets", lookupEnvOrInt("MAX_SUBNETS", defaultMaxSubnets), "maximum number of subnets tracked by memory store, the least recently seen are evicted, unlimited if 0")
+	flags.DurationVar(&c.IdleTimeout, "idle_timeout", lookupEnvOrDuration("IDLE_TIMEOUT", 0), "time without requests after which memory and bolt stores forget a subnet, at least the time its quota takes to restore")
+	flags.StringVar(&c.SnapshotPath, "snapshot_path", lookupEnvOrString("SNAPSHOT_PATH", ""), "file memory store state is saved to periodically and on shutdown and restored from on start, disabled if empty")
+	flags.DurationVar(&c.SnapshotEvery, "snapshot_interval", lookupEnvOrDuration("SNAPSHOT_INTERVAL", defaultSnapshotEvery), "interval of memory store snapshots")
+	flags.StringVar(&c.BoltPath, "bolt_path", lookupEnvOrString("BOLT_PATH", defaultBoltPath), "database file, used by bolt store")
+	flags.StringVar(&c.RedisAddr, "redis_addr", lookupEnvOrString("REDIS_ADDR", defaultRedisAddr), "redis address host:port, used by redis store")
+	flags.StringVar(&c.RedisPassword, "redis_password", lookupEnvOrString("REDIS_PASSWORD", ""), "redis password, used by redis store")
+	flags.IntVar(&c.RedisDB, "redis_db", lookupEnvOrInt("REDIS_DB", 0), "redis database number, used by redis store")
+	flags.IntVar(&c.GrpcPort, "grpc_port", lookupEnvOrInt("GRPC_PORT", 0), "port of Envoy ext_authz grpc server, disabled if 0")
+	flags.StringVar(&v.trustedProxies, "trusted_proxies", lookupEnvOrString("TRUSTED_PROXIES", DefaultTrustedProxies), "comma separated CIDRs of proxies trusted to set X-Forwarded-For")
+	flags.StringVar(&v.ipSources, "ip_sources", lookupEnvOrString("IP_SOURCES", DefaultIpSources), "comma separated ordered client ip sources [forwarded|x-forwarded-for|x-real-ip|remote-addr]")
+	flags.BoolVar(&c.ProxyProtocol, "proxy_protocol", lookupEnvOrBool("PROXY_PROTOCOL", false), "accept PROXY protocol v1/v2 headers from trusted proxies")
+	flags.StringVar(&v.allowList, "allow_list", lookupEnvOrString("ALLOW_LIST", ""), "comma separated CIDRs never rate limited")
+	flags.StringVar(&v.allowListFile, "allow_list_file", lookupEnvOrString("ALLOW_LIST_FILE", ""), "file of CIDRs never rate limited, one per line")
+	flags.StringVar(&v.denyList, "deny_list", lookupEnvOrString("DENY_LIST", ""), "comma separated CIDRs always denied with 403")
+	flags.StringVar(&v.denyListFile, "deny_list_file", lookupEnvOrString("DENY_LIST_FILE", ""), "file of CIDRs always denied with 403, one per line")
+	flags.StringVar(&c.AdminToken, "admin_token", lookupEnvOrString("ADMIN_TOKEN", ""), "bearer token of /reset, /metrics and the admin API")
+	flags.StringVar(&c.AdminHMACKey, "admin_hmac_key", lookupEnvOrString("ADMIN_HMAC_KEY", ""), "key of HMAC-SHA256 signed requests to /reset, /metrics and the admin API")
+	flags.IntVar(&c.AdminPort, "admin_port", lookupEnvOrInt("ADMIN_PORT", 0), "port of /reset, /metrics and the admin API, served on the main port if 0")
+	flags.StringVar(&c.Upstream, "upstream", lookupEnvOrString("UPSTREAM", ""), "upstream URL to proxy allowed requests to, static content is served if empty")
+	flags.StringVar(&c.ForwardAuthPath, "forward_auth_path", lookupEnvOrString("FORWARD_AUTH_PATH", ""), "path of the forward-auth endpoint for nginx auth_request and Traefik ForwardAuth, e.g. /auth, disabled if empty")
+	flags.DurationVar(&c.ReadTimeout, "read_timeout", lookupEnvOrDuration("READ_TIMEOUT", defaultServerTimeout), "timeout of reading a request, of its headers only in upstream mode")
+	flags.DurationVar(&c.WriteTimeout, "write_timeout", lookupEnvOrDuration("WRITE_TIMEOUT", defaultServerTimeout), "timeout of writing a response, not applied to proxied responses in upstream mode")
+	return c, v
+}
+
+func lookupEnvOrString(key string, defaultVal string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return defaultVal
 }
 
 func lookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
@@ -42,6 +121,17 @@ func lookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
 	return defaultVal
 }
 
+func lookupEnvOrBool(key string, defaultVal bool) bool {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Fatalf("illegal value for ENV %s: %v", key, err)
+		}
+		return v
+	}
+	return defaultVal
+}
+
 func lookupEnvOrInt(key string, defaultVal int) int {
 	if val, ok := os.LookupEnv(key); ok {
 		v, err := strconv.Atoi(val)
@@ -53,31 +143,232 @@ func lookupEnvOrInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
+// NewConfigs parses the command line flags, a flag defaults to its environment variable.
+// The flags have a flag set of their own, so that importing the package registers no flags.
 func NewConfigs() Config {
-	flag.Parse()
-	validateCLIArgs()
-	c := Config{
-		Port:            port,
-		PrefixSize:      prefixSize,
-		RequestLimit:    requestLimit,
-		TimeInterval:    interval,
-		BlockingTimeout: blockingTimeout,
-	}
-	log.Printf("Configuration: %+v", c)
-	return c
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	c, v := registerFlags(flags)
+	flags.Parse(os.Args[1:])
+	c.TrustedProxies = SplitList(v.trustedProxies)
+	c.IpSources = SplitList(v.ipSources)
+	validateCLIArgs(*c)
+	c.AllowList = loadCIDRList("allow list", v.allowList, v.allowListFile)
+	c.DenyList = loadCIDRList("deny list", v.denyList, v.denyListFile)
+
+	logged := *c
+	if logged.RedisPassword != "" {
+		logged.RedisPassword = "***"
+	}
+	if logged.AdminToken != "" {
+		logged.AdminToken = "***"
+	}
+	if logged.AdminHMACKey != "" {
+		logged.AdminHMACKey = "***"
+	}
+	log.Printf("Configuration: %+v", logged)
+	return *c
 }
 
-func validateCLIArgs() {
-	if prefixSize < 0 || prefixSize > 32 {
+func validateCLIArgs(c Config) {
+	if c.PrefixSize < 0 || c.PrefixSize > 32 {
 		log.Fatalf("Illegal argument subnet prefix length!")
 	}
+	if c.PrefixSizeV6 < 0 || c.PrefixSizeV6 > 128 {
+		log.Fatalf("Illegal argument IPv6 subnet prefix length!")
+	}
+	if err := validateRate(c.RequestLimit, c.TimeInterval); err != nil {
+		log.Fatalf("Illegal argument %v!", err)
+	}
+	if c.Store != StoreMemory && c.Store != StoreRedis && c.Store != StoreBolt {
+		log.Fatalf("Illegal argument store type %q!", c.Store)
+	}
+	if err := validateAlgorithm(c.Algorithm, c.Store); err != nil {
+		log.Fatalf("Illegal argument %v!", err)
+	}
+	if c.Burst < 0 {
+		log.Fatalf("Illegal argument burst!")
+	}
+	if c.MaxSubnets < 0 {
+		log.Fatalf("Illegal argument max subnets!")
+	}
+	if c.IdleTimeout < 0 {
+		log.Fatalf("Illegal argument idle timeout!")
+	}
+	if c.SnapshotPath != "" {
+		if c.Store != StoreMemory {
+			log.Fatalf("Illegal argument snapshot path is supported by memory store only!")
+		}
+		if c.SnapshotEvery <= 0 {
+			log.Fatalf("Illegal argument snapshot interval!")
+		}
+	}
+	if c.AdminPort < 0 || c.AdminPort > 65535 || (c.AdminPort != 0 && c.AdminPort == c.Port) {
+		log.Fatalf("Illegal argument admin port!")
+	}
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 {
+		log.Fatalf("Illegal argument server timeout!")
+	}
+	if c.Upstream != "" {
+		u, err := url.Parse(c.Upstream)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("Illegal argument upstream URL %q!", c.Upstream)
+		}
+	}
+	if c.ForwardAuthPath != "" && (!strings.HasPrefix(c.ForwardAuthPath, "/") || c.ForwardAuthPath == "/") {
+		log.Fatalf("Illegal argument forward-auth path %q!", c.ForwardAuthPath)
+	}
+	if _, err := ParseCIDRs(c.TrustedProxies); err != nil {
+		log.Fatalf("Illegal argument trusted proxies: %v", err)
+	}
+	if len(c.IpSources) == 0 {
+		log.Fatalf("Illegal argument client ip sources: empty list!")
+	}
+	for _, source := range c.IpSources {
+		switch strings.ToLower(source) {
+		case IpSourceForwarded, IpSourceXForwardedFor, IpSourceXRealIp, IpSourceRemoteAddr:
+		default:
+			log.Fatalf("Illegal argument client ip source %q!", source)
+		}
+	}
+}
+
+// validateAlgorithm rejects the unknown algorithms and the ones the store can not run,
+// redis store implements fixed window only
+func validateAlgorithm(algorithm string, storeType string) error {
+	switch algorithm {
+	case AlgorithmFixedWindow:
+	case AlgorithmTokenBucket, AlgorithmSlidingLog, AlgorithmSlidingWindow, AlgorithmGCRA:
+		if storeType == StoreRedis {
+			return fmt.Errorf("algorithm %q is not supported by redis store", algorithm)
+		}
+	default:
+		return fmt.Errorf("algorithm %q", algorithm)
+	}
+	return nil
+}
+
+// validateRate rejects the limits no algorithm can enforce, gcra divides the interval by the limit
+func validateRate(requestLimit int, interval time.Duration) error {
+	if requestLimit <= 0 {
+		return fmt.Errorf("request limit %d, expected positive", requestLimit)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("interval %v, expected positive", interval)
+	}
+	return nil
 }
 
 type Config struct {
 	Port int
 
 	PrefixSize      int
+	PrefixSizeV6    int
 	RequestLimit    int
 	TimeInterval    time.Duration
 	BlockingTimeout time.Duration
+
+	Store         string
+	Algorithm     string
+	Burst         int
+	MaxSubnets    int
+	IdleTimeout   time.Duration
+	SnapshotPath  string
+	SnapshotEvery time.Duration
+	BoltPath      string
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+
+	Upstream string
+	// ForwardAuthPath serves the forward-auth endpoint answering whether the client of the original request
+	// is allowed, it is disabled if empty. The path is not proxied to the upstream then.
+	ForwardAuthPath string
+	// ReadTimeout and WriteTimeout limit reading a request and writing a response, 10s if zero.
+	// In upstream mode only the headers are read with the timeout, so that proxied uploads
+	// and streamed responses are not cut off.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	GrpcPort     int
+
+	TrustedProxies []string
+	IpSources      []string
+	ProxyProtocol  bool
+
+	// AllowList are CIDRs never rate limited, DenyList are CIDRs always denied.
+	// The most specific network containing the client ip wins, deny wins between equal ones.
+	AllowList []string
+	DenyList  []string
+
+	// AdminToken is the bearer token and AdminHMACKey is the key of HMAC signed requests accepted by the admin
+	// endpoints: /reset, /metrics and the admin API. If both are empty /reset and the admin API are disabled
+	// and /metrics is public.
+	AdminToken   string
+	AdminHMACKey string
+	// AdminPort serves the admin endpoints on a separate listener, they are served on Port if 0.
+	AdminPort int
+}
+
+// loadCIDRList joins comma separated CIDRs with the ones read from the file
+func loadCIDRList(name string, list string, file string) []string {
+	res := SplitList(list)
+	if file != "" {
+		fromFile, err := ReadList(file)
+		if err != nil {
+			log.Fatalf("Illegal argument %s file: %v", name, err)
+		}
+		res = append(res, fromFile...)
+	}
+	if _, err := ParseCIDRs(res); err != nil {
+		log.Fatalf("Illegal argument %s: %v", name, err)
+	}
+	return res
+}
+
+// ReadList reads the values of the file one per line, skipping empty lines and comments starting with #.
+func ReadList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			res = append(res, line)
+		}
+	}
+	return res, nil
+}
+
+// SplitList splits comma separated values, skipping empty ones.
+func SplitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// ParseCIDRs parses networks in CIDR notation, a single address is treated as a network of itself.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			if ipv4 := ip.To4(); ipv4 != nil {
+				ip = ipv4
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ipNet)
+	}
+	return res, nil
 }
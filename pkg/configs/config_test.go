@@ -0,0 +1,72 @@
+package configs
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestValidateAlgorithm(t *testing.T) {
+	for _, tc := range []struct {
+		algorithm string
+		store     string
+		ok        bool
+	}{
+		{AlgorithmFixedWindow, StoreRedis, true},
+		{AlgorithmGCRA, StoreMemory, true},
+		{AlgorithmGCRA, StoreBolt, true},
+		{AlgorithmSlidingLog, StoreBolt, true},
+		{AlgorithmTokenBucket, StoreRedis, false},
+		{AlgorithmGCRA, StoreRedis, false},
+		{"leaky_bucket", StoreMemory, false},
+	} {
+		if err := validateAlgorithm(tc.algorithm, tc.store); (err == nil) != tc.ok {
+			t.Errorf("validateAlgorithm(%q, %q) error = %v", tc.algorithm, tc.store, err)
+		}
+	}
+}
+
+func TestValidateRate(t *testing.T) {
+	for _, tc := range []struct {
+		limit    int
+		interval time.Duration
+		ok       bool
+	}{
+		{10, time.Second, true},
+		{1, time.Millisecond, true},
+		{0, time.Second, false},
+		{-1, time.Second, false},
+		{10, 0, false},
+		{10, -time.Second, false},
+	} {
+		if err := validateRate(tc.limit, tc.interval); (err == nil) != tc.ok {
+			t.Errorf("validateRate(%d, %v) error = %v", tc.limit, tc.interval, err)
+		}
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	t.Setenv("PORT", "9000")
+	t.Setenv("INTERVAL", "5s")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	c, v := registerFlags(flags)
+	if err := flags.Parse([]string{"-port", "9090", "-trusted_proxies", "10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != 9090 {
+		t.Errorf("expected port of the flag, actual %d", c.Port)
+	}
+	if c.TimeInterval != 5*time.Second {
+		t.Errorf("expected interval of the environment variable, actual %v", c.TimeInterval)
+	}
+	if c.RequestLimit != defaultRequestLimit {
+		t.Errorf("expected default request limit, actual %d", c.RequestLimit)
+	}
+	if v.trustedProxies != "10.0.0.0/8" {
+		t.Errorf("expected trusted proxies of the flag, actual %q", v.trustedProxies)
+	}
+	if flag.Lookup("port") != nil {
+		t.Errorf("expected no flags registered in the command line flag set")
+	}
+}
@@ -0,0 +1,224 @@
+// Package middleware limits the rate of requests per client subnet for any net/http handler.
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/service"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeyFunc extracts the client ip the rate limit is applied to.
+type KeyFunc func(request *http.Request) (net.IP, error)
+
+// DeniedHandler renders the response for a request exceeding the rate limit.
+// Rate limit headers and Retry-After are already set when it is called.
+type DeniedHandler func(writer http.ResponseWriter, request *http.Request, quota store.Quota)
+
+// ErrorHandler renders the response when the client ip can not be extracted (status 400),
+// the client is denied by the access list (status 403) or the rate limit can not be checked (status 500).
+type ErrorHandler func(writer http.ResponseWriter, request *http.Request, status int, err error)
+
+// Callback is notified about every allowed or denied request.
+type Callback func(request *http.Request, ip net.IP, quota store.Quota)
+
+type options struct {
+	keyFunc       KeyFunc
+	checker       service.RateLimitChecker
+	deniedHandler DeniedHandler
+	errorHandler  ErrorHandler
+	onAllowed     Callback
+	onDenied      Callback
+	clock         clock.Clock
+	// store of WithStore, the checker is created once the clock is known
+	conf  configs.Config
+	store store.RateLimitStore
+}
+
+type Option func(*options)
+
+// WithKeyFunc sets the client ip extraction, FromRemoteAddr is used by default.
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(o *options) {
+		o.keyFunc = keyFunc
+	}
+}
+
+// WithChecker sets the checker deciding whether the client is limited.
+func WithChecker(checker service.RateLimitChecker) Option {
+	return func(o *options) {
+		o.checker = checker
+	}
+}
+
+// WithStore limits requests using the store, subnet prefix lengths are taken from conf.
+// Both PrefixSize and PrefixSizeV6 are required, so that the clients do not share a single subnet by mistake.
+func WithStore(conf configs.Config, rateLimitStore store.RateLimitStore) Option {
+	return func(o *options) {
+		o.conf = conf
+		o.store = rateLimitStore
+	}
+}
+
+// WithClock sets the time the rate limit headers are rendered at and the clock of the WithStore checker,
+// the system clock is used by default.
+func WithClock(clk clock.Clock) Option {
+	return func(o *options) {
+		o.clock = clk
+	}
+}
+
+// WithDeniedHandler sets the renderer of 429 responses.
+func WithDeniedHandler(handler DeniedHandler) Option {
+	return func(o *options) {
+		o.deniedHandler = handler
+	}
+}
+
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+func OnAllowed(callback Callback) Option {
+	return func(o *options) {
+		o.onAllowed = callback
+	}
+}
+
+func OnDenied(callback Callback) Option {
+	return func(o *options) {
+		o.onDenied = callback
+	}
+}
+
+// New creates the rate limiting middleware, either WithChecker or WithStore option is required.
+func New(opts ...Option) func(http.Handler) http.Handler {
+	o := &options{
+		keyFunc:       FromRemoteAddr,
+		deniedHandler: defaultDeniedHandler,
+		errorHandler:  defaultErrorHandler,
+		clock:         clock.New(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.store != nil {
+		if o.conf.PrefixSize < 1 || o.conf.PrefixSize > 32 || o.conf.PrefixSizeV6 < 1 || o.conf.PrefixSizeV6 > 128 {
+			panic(fmt.Sprintf("middleware: invalid subnet prefix lengths %d and %d of WithStore config, expected 1..32 and 1..128",
+				o.conf.PrefixSize, o.conf.PrefixSizeV6))
+		}
+		o.checker = service.NewServiceImpl(o.conf, o.store, o.clock)
+	}
+	if o.checker == nil {
+		panic("middleware: rate limit checker is not set, use WithChecker or WithStore option")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			ip, err := o.keyFunc(request)
+			if err != nil {
+				o.errorHandler(writer, request, http.StatusBadRequest, err)
+				return
+			}
+
+			isBlocked, quota, err := o.checker.IsLimitExceededForIp(ip)
+			if errors.Is(err, service.ErrDenied) {
+				o.errorHandler(writer, request, http.StatusForbidden, err)
+				return
+			}
+			if err != nil {
+				o.errorHandler(writer, request, http.StatusInternalServerError, err)
+				return
+			}
+
+			SetRateLimitHeaders(writer.Header(), quota, isBlocked, o.clock.Now())
+			if isBlocked {
+				if o.onDenied != nil {
+					o.onDenied(request, ip, quota)
+				}
+				o.deniedHandler(writer, request, quota)
+				return
+			}
+			if o.onAllowed != nil {
+				o.onAllowed(request, ip, quota)
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// SetRateLimitHeaders sets RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers
+// (draft-ietf-httpapi-ratelimit-headers) and Retry-After (RFC 6585) for blocked clients.
+// No headers are set for clients without limit, e.g. allowlisted ones, they get zero quota.
+func SetRateLimitHeaders(header http.Header, quota store.Quota, isBlocked bool, now time.Time) {
+	if quota.Limit == 0 && !isBlocked {
+		return
+	}
+	reset := ceilSeconds(quota.ResetAfter(now))
+	header.Set("RateLimit-Limit", strconv.Itoa(quota.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(quota.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(reset))
+	if isBlocked {
+		if reset < 1 {
+			reset = 1
+		}
+		header.Set("Retry-After", strconv.Itoa(reset))
+	}
+}
+
+// FromRemoteAddr uses the address of the direct peer.
+func FromRemoteAddr(request *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("bad request : invalid remote address %s", request.RemoteAddr)
+	}
+	return normalizeIp(ip), nil
+}
+
+// FromHeader uses the first value of the header.
+func FromHeader(name string) KeyFunc {
+	return func(request *http.Request) (net.IP, error) {
+		header, ok := request.Header[http.CanonicalHeaderKey(name)]
+		if !ok || len(header) == 0 {
+			return nil, fmt.Errorf("bad request : empty %s header", name)
+		}
+		ip := net.ParseIP(header[0])
+		if ip == nil {
+			return nil, fmt.Errorf("bad request : invalid %s header value - expected IPv4 or IPv6 address", name)
+		}
+		return normalizeIp(ip), nil
+	}
+}
+
+func normalizeIp(ip net.IP) net.IP {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4
+	}
+	return ip
+}
+
+func defaultDeniedHandler(writer http.ResponseWriter, request *http.Request, quota store.Quota) {
+	http.Error(writer, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+func defaultErrorHandler(writer http.ResponseWriter, request *http.Request, status int, err error) {
+	writer.WriteHeader(status)
+	writer.Write([]byte(err.Error()))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,208 @@
+package middleware_test
+
+import (
+	"errors"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/middleware"
+	"github.com/asavt7/antibot-developer-trainee/pkg/mocks"
+	"github.com/asavt7/antibot-developer-trainee/pkg/service"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var okHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+	writer.Write([]byte("ok"))
+})
+
+func serve(handler http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestNew(t *testing.T) {
+	checker := &mocks.RateLimitCheckerMockService{}
+
+	t.Run("allowed, remote addr is used by default", func(t *testing.T) {
+		var ipArg net.IP
+		checker.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			ipArg = ip
+			return false, store.Quota{Limit: 5, Remaining: 4, ResetAt: time.Now().Add(2 * time.Second)}, nil
+		}
+		var allowedIp net.IP
+		handler := middleware.New(
+			middleware.WithChecker(checker),
+			middleware.OnAllowed(func(request *http.Request, ip net.IP, quota store.Quota) {
+				allowedIp = ip
+			}),
+		)(okHandler)
+
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = "[2001:db8::1]:4321"
+		res := serve(handler, request)
+
+		if res.Code != http.StatusOK || res.Body.String() != "ok" {
+			t.Errorf("expected next handler response, actual %d %s", res.Code, res.Body)
+		}
+		if !ipArg.Equal(net.ParseIP("2001:db8::1")) || !allowedIp.Equal(ipArg) {
+			t.Errorf("expected remote address, actual %s, callback %s", ipArg, allowedIp)
+		}
+		if h := res.Header().Get("RateLimit-Remaining"); h != "4" {
+			t.Errorf("expected RateLimit-Remaining 4, actual %q", h)
+		}
+		if h := res.Header().Get("RateLimit-Reset"); h != "2" {
+			t.Errorf("expected RateLimit-Reset 2, actual %q", h)
+		}
+	})
+
+	t.Run("denied, custom key and renderer", func(t *testing.T) {
+		checker.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return true, store.Quota{Limit: 5, BlockedUntil: time.Now().Add(10 * time.Second)}, nil
+		}
+		denied := 0
+		handler := middleware.New(
+			middleware.WithChecker(checker),
+			middleware.WithKeyFunc(middleware.FromHeader("X-Real-IP")),
+			middleware.WithDeniedHandler(func(writer http.ResponseWriter, request *http.Request, quota store.Quota) {
+				writer.WriteHeader(http.StatusTooManyRequests)
+				writer.Write([]byte("slow down"))
+			}),
+			middleware.OnDenied(func(request *http.Request, ip net.IP, quota store.Quota) {
+				denied++
+			}),
+		)(okHandler)
+
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("X-Real-IP", "111.111.111.111")
+		res := serve(handler, request)
+
+		if res.Code != http.StatusTooManyRequests || res.Body.String() != "slow down" {
+			t.Errorf("expected custom 429 response, actual %d %s", res.Code, res.Body)
+		}
+		if h := res.Header().Get("Retry-After"); h != "10" {
+			t.Errorf("expected Retry-After 10, actual %q", h)
+		}
+		if denied != 1 {
+			t.Errorf("expected OnDenied callback to be called once, actual %d", denied)
+		}
+	})
+
+	t.Run("key extraction error", func(t *testing.T) {
+		handler := middleware.New(
+			middleware.WithChecker(checker),
+			middleware.WithKeyFunc(middleware.FromHeader("X-Real-IP")),
+		)(okHandler)
+
+		res := serve(handler, httptest.NewRequest("GET", "/", nil))
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, actual %d", res.Code)
+		}
+	})
+
+	t.Run("checker error, custom error handler", func(t *testing.T) {
+		checker.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return false, store.Quota{}, errors.New("error")
+		}
+		var statusArg int
+		handler := middleware.New(
+			middleware.WithChecker(checker),
+			middleware.WithErrorHandler(func(writer http.ResponseWriter, request *http.Request, status int, err error) {
+				statusArg = status
+				writer.WriteHeader(http.StatusServiceUnavailable)
+			}),
+		)(okHandler)
+
+		res := serve(handler, httptest.NewRequest("GET", "/", nil))
+		if statusArg != http.StatusInternalServerError || res.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected error handler called with 500, actual %d, response %d", statusArg, res.Code)
+		}
+	})
+
+	t.Run("denied by access list", func(t *testing.T) {
+		checker.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return false, store.Quota{}, service.ErrDenied
+		}
+		handler := middleware.New(middleware.WithChecker(checker))(okHandler)
+
+		res := serve(handler, httptest.NewRequest("GET", "/", nil))
+		if res.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, actual %d", res.Code)
+		}
+		if h := res.Header().Get("RateLimit-Limit"); h != "" {
+			t.Errorf("expected no rate limit headers, actual RateLimit-Limit %q", h)
+		}
+	})
+
+	t.Run("allowed without limit", func(t *testing.T) {
+		checker.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return false, store.Quota{}, nil
+		}
+		handler := middleware.New(middleware.WithChecker(checker))(okHandler)
+
+		res := serve(handler, httptest.NewRequest("GET", "/", nil))
+		if res.Code != http.StatusOK {
+			t.Errorf("expected status 200, actual %d", res.Code)
+		}
+		if h := res.Header().Get("RateLimit-Limit"); h != "" {
+			t.Errorf("expected no rate limit headers for unlimited client, actual RateLimit-Limit %q", h)
+		}
+	})
+
+	t.Run("with store", func(t *testing.T) {
+		var subnetArg string
+		storeMock := &mocks.RateLimitStoreMock{
+			TakeFunc: func(subnet string) (store.Decision, error) {
+				subnetArg = subnet
+				return store.Decision{Allowed: true, Limit: 1, Remaining: 0}, nil
+			},
+		}
+		handler := middleware.New(middleware.WithStore(configs.Config{PrefixSize: 16, PrefixSizeV6: 64}, storeMock))(okHandler)
+
+		res := serve(handler, httptest.NewRequest("GET", "/", nil))
+		if res.Code != http.StatusOK {
+			t.Errorf("expected status 200, actual %d", res.Code)
+		}
+		if subnetArg != "192.0.0.0" {
+			t.Errorf("expected subnet of remote address 192.0.2.1 by prefix 16, actual %s", subnetArg)
+		}
+	})
+
+	t.Run("headers rendered with clock", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		checker.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return true, store.Quota{Limit: 5, BlockedUntil: now.Add(1500 * time.Millisecond)}, nil
+		}
+		handler := middleware.New(middleware.WithChecker(checker), middleware.WithClock(clock.NewFake(now)))(okHandler)
+
+		res := serve(handler, httptest.NewRequest("GET", "/", nil))
+		if h := res.Header().Get("RateLimit-Reset"); h != "2" {
+			t.Errorf("expected RateLimit-Reset 2, actual %q", h)
+		}
+		if h := res.Header().Get("Retry-After"); h != "2" {
+			t.Errorf("expected Retry-After 2, actual %q", h)
+		}
+	})
+
+	t.Run("with store without prefix lengths", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic without prefix lengths")
+			}
+		}()
+		middleware.New(middleware.WithStore(configs.Config{PrefixSize: 24}, &mocks.RateLimitStoreMock{}))
+	})
+
+	t.Run("no checker", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic without checker")
+			}
+		}()
+		middleware.New()
+	})
+}
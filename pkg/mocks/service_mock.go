@@ -1,17 +1,19 @@
 package mocks
 
-import "net"
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"net"
+)
 
 type RateLimitCheckerMockService struct {
-	IsLimitExceededForIpFunc func(ipv4Addr net.IP) (bool, error)
-	ResetPrefixForIpv4Func   func(ipv4Addr net.IP) error
+	IsLimitExceededForIpFunc func(ip net.IP) (bool, store.Quota, error)
+	ResetPrefixesFunc        func(targets []string) ([]string, error)
 }
 
-func (m *RateLimitCheckerMockService) IsLimitExceededForIp(ipv4Addr net.IP) (bool, error) {
-	return m.IsLimitExceededForIpFunc(ipv4Addr)
+func (m *RateLimitCheckerMockService) IsLimitExceededForIp(ip net.IP) (bool, store.Quota, error) {
+	return m.IsLimitExceededForIpFunc(ip)
 }
 
-func (m *RateLimitCheckerMockService) ResetPrefixForIpv4(ipv4Addr net.IP) error {
-	return m.ResetPrefixForIpv4Func(ipv4Addr)
+func (m *RateLimitCheckerMockService) ResetPrefixes(targets []string) ([]string, error) {
+	return m.ResetPrefixesFunc(targets)
 }
-
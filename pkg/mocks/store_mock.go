@@ -1,14 +1,21 @@
 package mocks
 
+import "github.com/asavt7/antibot-developer-trainee/pkg/store"
+
 type RateLimitStoreMock struct {
-	CheckFunc func(subnet string) bool
-	ResetFunc func(subnet string)
+	TakeFunc    func(subnet string) (store.Decision, error)
+	ResetFunc   func(subnet string) (bool, error)
+	SubnetsFunc func() ([]store.SubnetState, error)
+}
+
+func (r *RateLimitStoreMock) Take(subnet string) (store.Decision, error) {
+	return r.TakeFunc(subnet)
 }
 
-func (r *RateLimitStoreMock) Check(subnet string) bool {
-	return r.CheckFunc(subnet)
+func (r *RateLimitStoreMock) Reset(subnet string) (bool, error) {
+	return r.ResetFunc(subnet)
 }
 
-func (r *RateLimitStoreMock) Reset(subnet string) {
-	r.ResetFunc(subnet)
+func (r *RateLimitStoreMock) Subnets() ([]store.SubnetState, error) {
+	return r.SubnetsFunc()
 }
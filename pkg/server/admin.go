@@ -0,0 +1,267 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// accessEntryRequest adds a network to the allow or deny list.
+type accessEntryRequest struct {
+	CIDR   string `json:"cidr"`
+	Reason string `json:"reason"`
+	// TTL is the lifetime of the entry in Go duration format, e.g. 1h30m, the entry never expires if empty.
+	TTL string `json:"ttl"`
+}
+
+type accessEntriesResponse struct {
+	Entries []store.AccessEntry `json:"entries"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// registerAdminHandlers adds the admin endpoints authenticated by adminAuth: /metrics, /reset, see resetHandler,
+// and the admin API managing the access lists at runtime:
+//
+//	GET    /admin/access[?list=allow|deny]   lists the entries
+//	POST   /admin/access/{list}              adds the entry of accessEntryRequest
+//	DELETE /admin/access/{list}?cidr=CIDR    removes the network from the list
+//
+// and inspecting the subnets tracked by the store, see subnetsHandler:
+//
+//	GET    /admin/subnets/blocked            blocked subnets, the most recently blocked first
+//	GET    /admin/subnets/top                subnets by the number of requests in the current window
+//
+// If no admin credentials are configured /reset and the admin API are disabled and /metrics is public.
+func (s *Server) registerAdminHandlers(mux *http.ServeMux) {
+	if s.config.AdminToken == "" && s.config.AdminHMACKey == "" {
+		log.Printf("admin credentials are not configured, /reset and the admin API are disabled")
+		mux.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
+		return
+	}
+	mux.HandleFunc("/metrics", s.adminAuth(promhttp.Handler().ServeHTTP))
+	mux.Handle("POST /reset", prometheusMiddleware("/reset", s.adminAuth(s.resetHandler)))
+	mux.HandleFunc("/reset", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	})
+	if s.service.AccessList != nil {
+		mux.HandleFunc("GET /admin/access", s.adminAuth(s.listAccessHandler))
+		mux.HandleFunc("POST /admin/access/{list}", s.adminAuth(s.addAccessHandler))
+		mux.HandleFunc("DELETE /admin/access/{list}", s.adminAuth(s.removeAccessHandler))
+	}
+	if s.service.Store != nil {
+		mux.HandleFunc("GET /admin/subnets/blocked", s.adminAuth(s.subnetsHandler(true, byBlockedAt)))
+		mux.HandleFunc("GET /admin/subnets/top", s.adminAuth(s.subnetsHandler(false, byCount)))
+	}
+}
+
+func (s *Server) listAccessHandler(writer http.ResponseWriter, request *http.Request) {
+	list := request.URL.Query().Get("list")
+	if list != "" && !isAccessList(list) {
+		writeJSON(writer, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("unknown access list %q", list)})
+		return
+	}
+	entries, err := s.service.AccessList.List()
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	res := accessEntriesResponse{Entries: make([]store.AccessEntry, 0, len(entries))}
+	for _, entry := range entries {
+		if list == "" || entry.List == list {
+			res.Entries = append(res.Entries, entry)
+		}
+	}
+	writeJSON(writer, http.StatusOK, res)
+}
+
+func (s *Server) addAccessHandler(writer http.ResponseWriter, request *http.Request) {
+	list := request.PathValue("list")
+	if !isAccessList(list) {
+		writeJSON(writer, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown access list %q", list)})
+		return
+	}
+	var req accessEntryRequest
+	if err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSON(writer, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	entry := store.AccessEntry{List: list, CIDR: req.CIDR, Reason: req.Reason}
+	if _, err := entry.Network(); err != nil {
+		writeJSON(writer, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid cidr: %v", err)})
+		return
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			writeJSON(writer, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid ttl %q", req.TTL)})
+			return
+		}
+		entry.ExpiresAt = s.service.Clock.Now().Add(ttl)
+	}
+
+	entry, err := s.service.AccessList.Add(entry)
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	log.Printf("added %s to %s list: %s", entry.CIDR, entry.List, entry.Reason)
+	writeJSON(writer, http.StatusCreated, entry)
+}
+
+func (s *Server) removeAccessHandler(writer http.ResponseWriter, request *http.Request) {
+	list := request.PathValue("list")
+	if !isAccessList(list) {
+		writeJSON(writer, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown access list %q", list)})
+		return
+	}
+	cidr := request.URL.Query().Get("cidr")
+	if _, err := (store.AccessEntry{CIDR: cidr}).Network(); err != nil {
+		writeJSON(writer, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid cidr: %v", err)})
+		return
+	}
+
+	removed, err := s.service.AccessList.Remove(list, cidr)
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	if !removed {
+		writeJSON(writer, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("%s is not in %s list", cidr, list)})
+		return
+	}
+	log.Printf("removed %s from %s list", cidr, list)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// pagination of subnets
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+type subnetResponse struct {
+	Subnet       string    `json:"subnet"`
+	Count        int       `json:"count"`
+	Limit        int       `json:"limit"`
+	Remaining    int       `json:"remaining"`
+	ResetAt      time.Time `json:"reset_at"`
+	BlockedAt    time.Time `json:"blocked_at,omitempty"`
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+}
+
+type subnetsResponse struct {
+	// Total is the number of subnets matching the filter
+	Total   int              `json:"total"`
+	Offset  int              `json:"offset"`
+	Limit   int              `json:"limit"`
+	Subnets []subnetResponse `json:"subnets"`
+}
+
+// byBlockedAt orders the most recently blocked subnets first
+func byBlockedAt(a, b store.SubnetState) bool {
+	if !a.BlockedAt.Equal(b.BlockedAt) {
+		return a.BlockedAt.After(b.BlockedAt)
+	}
+	return a.Subnet < b.Subnet
+}
+
+// byCount orders the subnets with the most requests first
+func byCount(a, b store.SubnetState) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return a.Subnet < b.Subnet
+}
+
+// subnetsHandler lists the subnets of the store in the order of less, only the blocked ones if blockedOnly is set.
+// The subnets are filtered by the optional cidr query parameter and paged by offset and limit, limit is 100 by default.
+func (s *Server) subnetsHandler(blockedOnly bool, less func(a, b store.SubnetState) bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		offset, limit, err := parsePage(query.Get("offset"), query.Get("limit"))
+		if err != nil {
+			writeJSON(writer, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		var filter *net.IPNet
+		if cidr := query.Get("cidr"); cidr != "" {
+			if filter, err = (store.AccessEntry{CIDR: cidr}).Network(); err != nil {
+				writeJSON(writer, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid cidr: %v", err)})
+				return
+			}
+		}
+
+		subnets, err := s.service.Store.Subnets()
+		if err != nil {
+			writeJSON(writer, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		matching := subnets[:0]
+		for _, state := range subnets {
+			if blockedOnly && state.BlockedUntil.IsZero() {
+				continue
+			}
+			if filter != nil && !filter.Contains(net.ParseIP(state.Subnet)) {
+				continue
+			}
+			matching = append(matching, state)
+		}
+		sort.Slice(matching, func(i, j int) bool {
+			return less(matching[i], matching[j])
+		})
+
+		res := subnetsResponse{Total: len(matching), Offset: offset, Limit: limit, Subnets: []subnetResponse{}}
+		for i := offset; i < len(matching) && i < offset+limit; i++ {
+			state := matching[i]
+			res.Subnets = append(res.Subnets, subnetResponse{
+				Subnet:       state.Subnet,
+				Count:        state.Count,
+				Limit:        state.Limit,
+				Remaining:    state.Remaining,
+				ResetAt:      state.ResetAt,
+				BlockedAt:    state.BlockedAt,
+				BlockedUntil: state.BlockedUntil,
+			})
+		}
+		writeJSON(writer, http.StatusOK, res)
+	}
+}
+
+func parsePage(offsetParam string, limitParam string) (int, int, error) {
+	offset, limit := 0, defaultPageLimit
+	var err error
+	if offsetParam != "" {
+		if offset, err = strconv.Atoi(offsetParam); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", offsetParam)
+		}
+	}
+	if limitParam != "" {
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("invalid limit %q, expected 1..%d", limitParam, maxPageLimit)
+		}
+	}
+	return offset, limit, nil
+}
+
+func isAccessList(list string) bool {
+	return list == store.AccessAllow || list == store.AccessDeny
+}
+
+func writeJSON(writer http.ResponseWriter, status int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(body); err != nil {
+		log.Println(err.Error())
+	}
+}
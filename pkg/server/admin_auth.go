@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headers of HMAC signed admin requests
+const (
+	AdminTimestampHeader = "X-Admin-Timestamp"
+	AdminNonceHeader     = "X-Admin-Nonce"
+	AdminSignatureHeader = "X-Admin-Signature"
+)
+
+// adminSignatureMaxAge limits the clock skew of signed requests, a nonce is accepted once within it
+const adminSignatureMaxAge = 5 * time.Minute
+
+// adminMaxNonce limits the length of the nonces kept to detect replays
+const adminMaxNonce = 128
+
+// adminNoncesPruneEvery is how often the expired nonces are forgotten
+const adminNoncesPruneEvery = time.Minute
+
+// adminMaxBody limits the body of the signed requests read into memory to verify the signature
+const adminMaxBody = 1 << 20
+
+// adminAuth allows the requests with the admin bearer token or signed by the admin HMAC key.
+// Requests without credentials get 401, requests with invalid credentials get 403.
+func (s *Server) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		scheme, token, _ := strings.Cut(request.Header.Get("Authorization"), " ")
+		bearer := strings.EqualFold(scheme, "Bearer")
+		signature := request.Header.Get(AdminSignatureHeader)
+
+		var err error
+		switch {
+		case bearer:
+			err = s.checkAdminToken(token)
+		case signature != "":
+			err = s.checkAdminSignature(writer, request, signature)
+		default:
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSON(writer, http.StatusUnauthorized, errorResponse{Error: "admin credentials required"})
+			return
+		}
+		if err != nil {
+			writeJSON(writer, http.StatusForbidden, errorResponse{Error: err.Error()})
+			return
+		}
+		next(writer, request)
+	}
+}
+
+func (s *Server) checkAdminToken(token string) error {
+	if s.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+		return errors.New("invalid admin token")
+	}
+	return nil
+}
+
+// checkAdminSignature verifies the signature of the request, the body is read and replaced by a copy
+func (s *Server) checkAdminSignature(writer http.ResponseWriter, request *http.Request, signature string) error {
+	if s.config.AdminHMACKey == "" {
+		return errors.New("signed admin requests are not accepted")
+	}
+	timestamp := request.Header.Get(AdminTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s", AdminTimestampHeader)
+	}
+	now := s.service.Clock.Now()
+	if age := now.Sub(time.Unix(seconds, 0)); age > adminSignatureMaxAge || age < -adminSignatureMaxAge {
+		return fmt.Errorf("%s is out of %v", AdminTimestampHeader, adminSignatureMaxAge)
+	}
+	nonce := request.Header.Get(AdminNonceHeader)
+	if nonce == "" || len(nonce) > adminMaxNonce {
+		return fmt.Errorf("invalid %s", AdminNonceHeader)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, adminMaxBody))
+	if err != nil {
+		return fmt.Errorf("read request body: %w", err)
+	}
+	request.Body = io.NopCloser(bytes.NewReader(body))
+
+	actual, err := hex.DecodeString(signature)
+	expected := adminSignature(s.config.AdminHMACKey, request.Method, request.URL.RequestURI(), timestamp, nonce, body)
+	if err != nil || !hmac.Equal(actual, expected) {
+		return errors.New("invalid admin signature")
+	}
+	if !s.adminNonces.add(nonce, time.Unix(seconds, 0).Add(adminSignatureMaxAge), now) {
+		return fmt.Errorf("%s is already used", AdminNonceHeader)
+	}
+	return nil
+}
+
+// seenNonces records the nonces of the accepted signed requests until their timestamps are out of
+// adminSignatureMaxAge, so that a captured signed request can not be replayed.
+type seenNonces struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	nextPrune time.Time
+}
+
+// add records the nonce, false if it is already recorded
+func (s *seenNonces) add(nonce string, expiresAt time.Time, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !now.Before(s.nextPrune) {
+		for seen, seenExpiresAt := range s.expires {
+			if !now.Before(seenExpiresAt) {
+				delete(s.expires, seen)
+			}
+		}
+		s.nextPrune = now.Add(adminNoncesPruneEvery)
+	}
+	if seenExpiresAt, ok := s.expires[nonce]; ok && now.Before(seenExpiresAt) {
+		return false
+	}
+	if s.expires == nil {
+		s.expires = make(map[string]time.Time)
+	}
+	s.expires[nonce] = expiresAt
+	return true
+}
+
+// SignAdminRequest signs the request made at now with the admin HMAC key and a random nonce. The signature is
+// the hex encoded HMAC-SHA256 of the method, the request URI, the unix timestamp in seconds, the nonce and the hex
+// encoded SHA-256 of the body, separated by newlines.
+func SignAdminRequest(request *http.Request, key string, now time.Time) error {
+	var body []byte
+	if request.Body != nil && request.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(request.Body); err != nil {
+			return err
+		}
+		request.Body.Close()
+		request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonce := hex.EncodeToString(nonceBytes)
+	request.Header.Set(AdminTimestampHeader, timestamp)
+	request.Header.Set(AdminNonceHeader, nonce)
+	request.Header.Set(AdminSignatureHeader, hex.EncodeToString(adminSignature(key, request.Method, request.URL.RequestURI(), timestamp, nonce, body)))
+	return nil
+}
+
+func adminSignature(key string, method string, uri string, timestamp string, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,215 @@
+package server_test
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/mocks"
+	"github.com/asavt7/antibot-developer-trainee/pkg/server"
+	"github.com/asavt7/antibot-developer-trainee/pkg/service"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const adminHMACKey = "hmac secret"
+
+func newAdminTestService() *service.Service {
+	storeMock := &mocks.RateLimitStoreMock{
+		SubnetsFunc: func() ([]store.SubnetState, error) {
+			return nil, nil
+		},
+	}
+	return &service.Service{
+		RateLimitChecker: &mocks.RateLimitCheckerMockService{
+			ResetPrefixesFunc: func(targets []string) ([]string, error) {
+				return targets, nil
+			},
+		},
+		Store: storeMock,
+		Clock: clock.New(),
+	}
+}
+
+func signedRequest(t *testing.T, method string, url string, body string, key string, now time.Time) *http.Request {
+	t.Helper()
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SignAdminRequest(r, key, now); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func do(t *testing.T, r *http.Request) *http.Response {
+	t.Helper()
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestAdminAuth(t *testing.T) {
+	conf := configs.Config{
+		TrustedProxies: configs.SplitList(configs.DefaultTrustedProxies),
+		AdminToken:     adminToken,
+		AdminHMACKey:   adminHMACKey,
+	}
+	testServ := httptest.NewServer(server.NewServer(conf, newAdminTestService(), &mockHandler{}).Handler)
+	defer testServ.Close()
+
+	endpoints := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/metrics", "", http.StatusOK},
+		{"POST", "/reset?target=10.0.0.1", `{"targets": ["10.0.1.1"]}`, http.StatusOK},
+		{"GET", "/admin/subnets/top?limit=5", "", http.StatusOK},
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		for _, e := range endpoints {
+			res := adminRequest(t, e.method, testServ.URL+e.path, "", e.body)
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%s %s: expected status 401, actual %d", e.method, e.path, res.StatusCode)
+			}
+			if res.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s: expected WWW-Authenticate header", e.method, e.path)
+			}
+		}
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		now := time.Now()
+		for _, e := range endpoints {
+			url := testServ.URL + e.path
+			if res := adminRequest(t, e.method, url, "wrong", e.body); res.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s: expected status 403 for wrong token, actual %d", e.method, e.path, res.StatusCode)
+			}
+			if res := do(t, signedRequest(t, e.method, url, e.body, "wrong", now)); res.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s: expected status 403 for wrong key, actual %d", e.method, e.path, res.StatusCode)
+			}
+			if res := do(t, signedRequest(t, e.method, url, e.body, adminHMACKey, now.Add(-10*time.Minute))); res.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s: expected status 403 for stale signature, actual %d", e.method, e.path, res.StatusCode)
+			}
+		}
+
+		tampered := signedRequest(t, "POST", testServ.URL+"/reset?target=10.0.0.1", "", adminHMACKey, now)
+		tampered.URL.RawQuery = "target=0.0.0.0/0"
+		if res := do(t, tampered); res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403 for tampered query, actual %d", res.StatusCode)
+		}
+		tampered = signedRequest(t, "POST", testServ.URL+"/reset", `{"targets": ["10.0.0.1"]}`, adminHMACKey, now)
+		tampered.Body = http.NoBody
+		tampered.ContentLength = 0
+		if res := do(t, tampered); res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403 for tampered body, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		for _, e := range endpoints {
+			url := testServ.URL + e.path
+			if res := adminRequest(t, e.method, url, adminToken, e.body); res.StatusCode != e.status {
+				t.Errorf("%s %s: expected status %d for bearer token, actual %d", e.method, e.path, e.status, res.StatusCode)
+			}
+			if res := do(t, signedRequest(t, e.method, url, e.body, adminHMACKey, time.Now())); res.StatusCode != e.status {
+				t.Errorf("%s %s: expected status %d for signed request, actual %d", e.method, e.path, e.status, res.StatusCode)
+			}
+		}
+	})
+
+	t.Run("bearer scheme is case-insensitive", func(t *testing.T) {
+		r, err := http.NewRequest("GET", testServ.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "bearer "+adminToken)
+		if res := do(t, r); res.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200 for lowercase scheme, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("replayed signature", func(t *testing.T) {
+		now := time.Now()
+		url := testServ.URL + "/reset?target=10.0.2.1"
+		signed := signedRequest(t, "POST", url, "", adminHMACKey, now)
+		if res := do(t, signed); res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 for signed request, actual %d", res.StatusCode)
+		}
+		replayed, err := http.NewRequest("POST", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed.Header = signed.Header.Clone()
+		if res := do(t, replayed); res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403 for replayed request, actual %d", res.StatusCode)
+		}
+
+		// identical requests signed in the same second differ by the nonce
+		for i := 0; i < 2; i++ {
+			if res := do(t, signedRequest(t, "POST", url, "", adminHMACKey, now)); res.StatusCode != http.StatusOK {
+				t.Errorf("expected status 200 for identical signed request %d, actual %d", i+1, res.StatusCode)
+			}
+		}
+
+		withoutNonce := signedRequest(t, "POST", url, "", adminHMACKey, now)
+		withoutNonce.Header.Del(server.AdminNonceHeader)
+		if res := do(t, withoutNonce); res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403 without nonce, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("signed requests not configured", func(t *testing.T) {
+		tokenConf := conf
+		tokenConf.AdminHMACKey = ""
+		tokenServ := httptest.NewServer(server.NewServer(tokenConf, newAdminTestService(), &mockHandler{}).Handler)
+		defer tokenServ.Close()
+
+		if res := do(t, signedRequest(t, "GET", tokenServ.URL+"/metrics", "", "", time.Now())); res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403 for request signed by empty key, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("no credentials configured", func(t *testing.T) {
+		openConf := conf
+		openConf.AdminToken, openConf.AdminHMACKey = "", ""
+		openServ := httptest.NewServer(server.NewServer(openConf, newAdminTestService(), &mockHandler{}).Handler)
+		defer openServ.Close()
+
+		if res := adminRequest(t, "GET", openServ.URL+"/metrics", "", ""); res.StatusCode != http.StatusOK {
+			t.Errorf("expected public metrics, actual %d", res.StatusCode)
+		}
+		if res := adminRequest(t, "POST", openServ.URL+"/reset?target=10.0.0.1", "", ""); res.StatusCode != http.StatusNotFound {
+			t.Errorf("expected reset disabled, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("admin port", func(t *testing.T) {
+		portConf := conf
+		portConf.AdminPort = 9090
+		serv := server.NewServer(portConf, newAdminTestService(), &mockHandler{})
+		publicServ := httptest.NewServer(serv.Handler)
+		defer publicServ.Close()
+		adminServ := httptest.NewServer(serv.Admin.Handler)
+		defer adminServ.Close()
+
+		if serv.Admin.Addr != ":9090" {
+			t.Errorf("expected admin server at :9090, actual %s", serv.Admin.Addr)
+		}
+		for _, e := range endpoints {
+			if res := adminRequest(t, e.method, publicServ.URL+e.path, adminToken, e.body); res.StatusCode != http.StatusNotFound {
+				t.Errorf("%s %s: expected not served by main listener, actual %d", e.method, e.path, res.StatusCode)
+			}
+			if res := adminRequest(t, e.method, adminServ.URL+e.path, adminToken, e.body); res.StatusCode != e.status {
+				t.Errorf("%s %s: expected status %d from admin listener, actual %d", e.method, e.path, e.status, res.StatusCode)
+			}
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/mocks"
+	"github.com/asavt7/antibot-developer-trainee/pkg/server"
+	"github.com/asavt7/antibot-developer-trainee/pkg/service"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const adminToken = "secret"
+
+func adminRequest(t *testing.T, method string, url string, token string, body string) *http.Response {
+	t.Helper()
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestAdminAccessHandlers(t *testing.T) {
+	storeMock := &mocks.RateLimitStoreMock{
+		TakeFunc: func(subnet string) (store.Decision, error) {
+			return store.Decision{Allowed: true, Limit: 10, Remaining: 9}, nil
+		},
+	}
+	conf := configs.Config{
+		PrefixSize:     24,
+		PrefixSizeV6:   64,
+		TrustedProxies: configs.SplitList(configs.DefaultTrustedProxies),
+		AdminToken:     adminToken,
+	}
+	testServ := httptest.NewServer(server.NewServer(conf, service.NewServiceImpl(conf, storeMock, clock.New()), &mockHandler{}).Handler)
+	defer testServ.Close()
+	accessUrl := testServ.URL + "/admin/access"
+
+	clientRequest := func() *http.Response {
+		r, _ := http.NewRequest("GET", testServ.URL+"/", nil)
+		r.Header.Set("X-Forwarded-For", "198.51.100.7")
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	t.Run("add, list and remove", func(t *testing.T) {
+		res := adminRequest(t, "POST", accessUrl+"/deny", adminToken, `{"cidr": "198.51.100.0/24", "reason": "incident", "ttl": "1h"}`)
+		if res.StatusCode != http.StatusCreated {
+			body, _ := io.ReadAll(res.Body)
+			t.Fatalf("expected status 201, actual %d %s", res.StatusCode, body)
+		}
+		var entry store.AccessEntry
+		if err := json.NewDecoder(res.Body).Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.List != store.AccessDeny || entry.Reason != "incident" || entry.ExpiresAt.IsZero() {
+			t.Errorf("expected created entry with expiry, actual %+v", entry)
+		}
+		if res := clientRequest(); res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected denied client forbidden immediately, actual %d", res.StatusCode)
+		}
+
+		res = adminRequest(t, "GET", accessUrl+"?list=deny", adminToken, "")
+		var list struct {
+			Entries []store.AccessEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Entries) != 1 || list.Entries[0].CIDR != "198.51.100.0/24" {
+			t.Errorf("expected listed entry, actual %+v", list.Entries)
+		}
+
+		res = adminRequest(t, "DELETE", accessUrl+"/deny?cidr=198.51.100.0/24", adminToken, "")
+		if res.StatusCode != http.StatusNoContent {
+			t.Errorf("expected status 204, actual %d", res.StatusCode)
+		}
+		if res := clientRequest(); res.StatusCode != http.StatusOK {
+			t.Errorf("expected client allowed after removal, actual %d", res.StatusCode)
+		}
+		res = adminRequest(t, "DELETE", accessUrl+"/deny?cidr=198.51.100.0/24", adminToken, "")
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status 404 for missing entry, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, tc := range []struct {
+			method, url, body string
+			status            int
+		}{
+			{"POST", "/block", `{"cidr": "10.0.0.0/8"}`, http.StatusNotFound},
+			{"POST", "/allow", `{"cidr": "10.0.0.0/33"}`, http.StatusBadRequest},
+			{"POST", "/allow", `{"cidr": "10.0.0.0/8", "ttl": "forever"}`, http.StatusBadRequest},
+			{"POST", "/allow", `not json`, http.StatusBadRequest},
+			{"DELETE", "/allow?cidr=qwe", "", http.StatusBadRequest},
+			{"GET", "?list=block", "", http.StatusBadRequest},
+		} {
+			res := adminRequest(t, tc.method, accessUrl+tc.url, adminToken, tc.body)
+			if res.StatusCode != tc.status {
+				t.Errorf("%s %s %s: expected status %d, actual %d", tc.method, tc.url, tc.body, tc.status, res.StatusCode)
+			}
+		}
+	})
+
+	t.Run("disabled without token", func(t *testing.T) {
+		noAdminConf := conf
+		noAdminConf.AdminToken = ""
+		noAdminServ := httptest.NewServer(server.NewServer(noAdminConf, service.NewServiceImpl(noAdminConf, storeMock, clock.New()), &mockHandler{}).Handler)
+		defer noAdminServ.Close()
+
+		res := adminRequest(t, "POST", fmt.Sprintf("%s/admin/access/allow", noAdminServ.URL), "", `{"cidr": "10.0.0.0/8"}`)
+		if res.StatusCode == http.StatusCreated {
+			t.Errorf("expected admin API disabled")
+		}
+	})
+}
+
+func TestAdminSubnetsHandlers(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	storeMock := &mocks.RateLimitStoreMock{
+		SubnetsFunc: func() ([]store.SubnetState, error) {
+			return []store.SubnetState{
+				{Subnet: "10.0.1.0", Count: 3, Quota: store.Quota{Limit: 10, Remaining: 7}},
+				{Subnet: "10.0.2.0", Count: 11, BlockedAt: now.Add(-time.Minute),
+					Quota: store.Quota{Limit: 10, BlockedUntil: now.Add(time.Minute)}},
+				{Subnet: "192.168.0.0", Count: 12, BlockedAt: now,
+					Quota: store.Quota{Limit: 10, BlockedUntil: now.Add(2 * time.Minute)}},
+				{Subnet: "10.0.3.0", Count: 5, Quota: store.Quota{Limit: 10, Remaining: 5}},
+			}, nil
+		},
+	}
+	conf := configs.Config{
+		PrefixSize:     24,
+		PrefixSizeV6:   64,
+		TrustedProxies: configs.SplitList(configs.DefaultTrustedProxies),
+		AdminToken:     adminToken,
+	}
+	testServ := httptest.NewServer(server.NewServer(conf, service.NewServiceImpl(conf, storeMock, clock.New()), &mockHandler{}).Handler)
+	defer testServ.Close()
+
+	type subnetsResponse struct {
+		Total   int `json:"total"`
+		Subnets []struct {
+			Subnet       string    `json:"subnet"`
+			Count        int       `json:"count"`
+			BlockedAt    time.Time `json:"blocked_at"`
+			BlockedUntil time.Time `json:"blocked_until"`
+		} `json:"subnets"`
+	}
+	get := func(t *testing.T, path string) (subnetsResponse, []string) {
+		t.Helper()
+		res := adminRequest(t, "GET", testServ.URL+path, adminToken, "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: expected status 200, actual %d", path, res.StatusCode)
+		}
+		var body subnetsResponse
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		subnets := make([]string, 0, len(body.Subnets))
+		for _, s := range body.Subnets {
+			subnets = append(subnets, s.Subnet)
+		}
+		return body, subnets
+	}
+
+	t.Run("blocked", func(t *testing.T) {
+		body, subnets := get(t, "/admin/subnets/blocked")
+		if body.Total != 2 || !reflect.DeepEqual(subnets, []string{"192.168.0.0", "10.0.2.0"}) {
+			t.Fatalf("expected blocked subnets most recent first, actual %+v", body)
+		}
+		if s := body.Subnets[1]; s.Count != 11 || !s.BlockedAt.Equal(now.Add(-time.Minute)) || !s.BlockedUntil.Equal(now.Add(time.Minute)) {
+			t.Errorf("expected block start, expiry and count, actual %+v", s)
+		}
+		if body, subnets := get(t, "/admin/subnets/blocked?cidr=10.0.0.0/16"); body.Total != 1 || !reflect.DeepEqual(subnets, []string{"10.0.2.0"}) {
+			t.Errorf("expected blocked subnets filtered by cidr, actual %+v", body)
+		}
+	})
+
+	t.Run("top", func(t *testing.T) {
+		_, subnets := get(t, "/admin/subnets/top?limit=3")
+		if !reflect.DeepEqual(subnets, []string{"192.168.0.0", "10.0.2.0", "10.0.3.0"}) {
+			t.Errorf("expected top subnets by count, actual %v", subnets)
+		}
+		body, subnets := get(t, "/admin/subnets/top?cidr=10.0.0.0/16&offset=1&limit=1")
+		if body.Total != 3 || !reflect.DeepEqual(subnets, []string{"10.0.3.0"}) {
+			t.Errorf("expected second page of filtered subnets, actual %+v", body)
+		}
+		if _, subnets := get(t, "/admin/subnets/top?offset=10"); len(subnets) != 0 {
+			t.Errorf("expected empty page past the end, actual %v", subnets)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, query := range []string{"?limit=0", "?limit=1001", "?offset=-1", "?offset=a", "?cidr=10.0.0.0/33"} {
+			if res := adminRequest(t, "GET", testServ.URL+"/admin/subnets/top"+query, adminToken, ""); res.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, actual %d", query, res.StatusCode)
+			}
+		}
+		if res := adminRequest(t, "GET", testServ.URL+"/admin/subnets/blocked", "", ""); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status 401 without token, actual %d", res.StatusCode)
+		}
+	})
+}
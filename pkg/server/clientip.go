@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/middleware"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are networks of proxies allowed to report the client ip in request headers.
+type TrustedProxies []*net.IPNet
+
+func (t TrustedProxies) Contains(ip net.IP) bool {
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IpSource looks for the client ip in a single place of the request, peer is the address of the direct peer.
+// It returns nil ip if the source is not present or can not be trusted.
+type IpSource func(request *http.Request, peer net.IP, trusted TrustedProxies) (net.IP, error)
+
+// ClientIpExtractor consults the sources in order and returns the ip of the first present one.
+type ClientIpExtractor struct {
+	sources []IpSource
+	trusted TrustedProxies
+}
+
+func NewClientIpExtractor(trusted TrustedProxies, sources ...IpSource) *ClientIpExtractor {
+	return &ClientIpExtractor{sources: sources, trusted: trusted}
+}
+
+// ParseIpSources maps configs.IpSource* names to sources.
+func ParseIpSources(names []string) ([]IpSource, error) {
+	sources := make([]IpSource, 0, len(names))
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case configs.IpSourceForwarded:
+			sources = append(sources, ForwardedSource)
+		case configs.IpSourceXForwardedFor:
+			sources = append(sources, ForwardedForSource("X-Forwarded-For"))
+		case configs.IpSourceXRealIp:
+			sources = append(sources, HeaderSource("X-Real-IP"))
+		case configs.IpSourceRemoteAddr:
+			sources = append(sources, RemoteAddrSource)
+		default:
+			return nil, fmt.Errorf("unknown client ip source %q", name)
+		}
+	}
+	return sources, nil
+}
+
+func (e *ClientIpExtractor) ClientIp(request *http.Request) (net.IP, error) {
+	peer, err := middleware.FromRemoteAddr(request)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range e.sources {
+		ip, err := source(request, peer, e.trusted)
+		if err != nil {
+			return nil, err
+		}
+		if ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("bad request : client ip not found")
+}
+
+// RemoteAddrSource returns the direct peer unless it is a trusted proxy.
+func RemoteAddrSource(request *http.Request, peer net.IP, trusted TrustedProxies) (net.IP, error) {
+	if trusted.Contains(peer) {
+		return nil, nil
+	}
+	return peer, nil
+}
+
+// HeaderSource returns the address in a single value header like X-Real-IP set by a trusted proxy.
+func HeaderSource(name string) IpSource {
+	return func(request *http.Request, peer net.IP, trusted TrustedProxies) (net.IP, error) {
+		value := strings.TrimSpace(request.Header.Get(name))
+		if value == "" || !trusted.Contains(peer) {
+			return nil, nil
+		}
+		ip := parseNode(value)
+		if ip == nil {
+			return nil, fmt.Errorf("bad request : invalid %s header value %q - expected IPv4 or IPv6 address", name, value)
+		}
+		return ip, nil
+	}
+}
+
+// ForwardedForSource returns the client from the comma separated chain in a header like X-Forwarded-For.
+func ForwardedForSource(name string) IpSource {
+	return func(request *http.Request, peer net.IP, trusted TrustedProxies) (net.IP, error) {
+		var hops []string
+		for _, value := range request.Header.Values(name) {
+			hops = append(hops, splitQuoted(value, ',')...)
+		}
+		return walkChain(name, hops, peer, trusted)
+	}
+}
+
+// ForwardedSource returns the client from the for= parameters of RFC 7239 Forwarded header.
+func ForwardedSource(request *http.Request, peer net.IP, trusted TrustedProxies) (net.IP, error) {
+	var hops []string
+	for _, value := range request.Header.Values("Forwarded") {
+		for _, element := range splitQuoted(value, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				if eq := strings.IndexByte(pair, '='); eq > 0 && strings.EqualFold(strings.TrimSpace(pair[:eq]), "for") {
+					hops = append(hops, strings.TrimSpace(pair[eq+1:]))
+				}
+			}
+		}
+	}
+	return walkChain("Forwarded", hops, peer, trusted)
+}
+
+// walkChain walks the forwarded chain from the right starting with the direct peer, trusted proxies are skipped
+// and the first untrusted address is the client. The chain is ignored if the direct peer is not a trusted proxy,
+// as anyone can set the header.
+//
+// A hidden node, see isHiddenNode, is the boundary of the untrusted part of the chain: the last trusted hop
+// is the client then, or the next source is consulted if the direct peer hid its client.
+func walkChain(name string, hops []string, peer net.IP, trusted TrustedProxies) (net.IP, error) {
+	if len(hops) == 0 || !trusted.Contains(peer) {
+		return nil, nil
+	}
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		if isHiddenNode(hops[i]) {
+			return ip, nil
+		}
+		ip = parseNode(hops[i])
+		if ip == nil {
+			return nil, fmt.Errorf("bad request : invalid %s header value %q - expected IPv4 or IPv6 address", name, hops[i])
+		}
+		if !trusted.Contains(ip) {
+			return ip, nil
+		}
+	}
+	// the whole chain is trusted, the leftmost address is the origin
+	return ip, nil
+}
+
+// parseNode parses an address optionally quoted, with a port or in brackets: 192.0.2.1, "[2001:db8::1]:4711".
+func parseNode(node string) net.IP {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return nil
+		}
+		node = node[1:end]
+	} else if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	ip := net.ParseIP(node)
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4
+	}
+	return ip
+}
+
+// isHiddenNode reports RFC 7239 node names not revealing the address, unknown or an obfuscated identifier
+// like _hidden, optionally with a port: "unknown:4711", "_gazonk:_port".
+func isHiddenNode(node string) bool {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if name, _, ok := strings.Cut(node, ":"); ok && strings.Count(node, ":") == 1 {
+		node = name
+	}
+	return strings.EqualFold(node, "unknown") || strings.HasPrefix(node, "_")
+}
+
+// splitQuoted splits s by sep outside of quoted strings, skipping empty parts.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] == '"' {
+			quoted = !quoted
+		}
+		if i == len(s) || (s[i] == sep && !quoted) {
+			if part := strings.TrimSpace(s[start:i]); part != "" {
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	return parts
+}
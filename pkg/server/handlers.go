@@ -1,10 +1,15 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/middleware"
+	"github.com/asavt7/antibot-developer-trainee/pkg/service"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
 	"html/template"
+	"io"
 	"log"
-	"net"
 	"net/http"
 	"time"
 )
@@ -24,70 +29,94 @@ func initTemplates() {
 	ToManyReqTemplate = tmpl
 }
 
+// maxResetTargets limits the number of targets reset by one request
+const maxResetTargets = 1000
+
+// resetRequest is the JSON body of /reset, the targets are added to the ones of the target query parameters.
+type resetRequest struct {
+	Targets []string `json:"targets"`
+}
+
+type resetResponse struct {
+	// Reset lists the subnets that were tracked by the store.
+	Reset []string `json:"reset"`
+}
+
+// resetHandler resets the subnets of the ips and CIDRs given by the repeated target query parameter
+// and the resetRequest body, e.g. POST /reset?target=203.0.113.7&target=198.51.100.0/22.
 func (s *Server) resetHandler(writer http.ResponseWriter, request *http.Request) {
-	ipv4, err := parseHeaderXForwardedFor(request.Header)
-	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte(err.Error()))
+	targets := request.URL.Query()["target"]
+	var req resetRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 1<<20)).Decode(&req)
+	if err != nil && err != io.EOF {
+		writeJSON(writer, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	targets = append(targets, req.Targets...)
+	if len(targets) == 0 || len(targets) > maxResetTargets {
+		writeJSON(writer, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("expected 1..%d targets, actual %d", maxResetTargets, len(targets))})
 		return
 	}
 
-	err = s.service.ResetPrefixForIpv4(ipv4)
+	reset, err := s.service.ResetPrefixes(targets)
+	if errors.Is(err, service.ErrInvalidTarget) {
+		writeJSON(writer, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		writer.Write([]byte(err.Error()))
+		writeJSON(writer, http.StatusInternalServerError, errorResponse{Error: err.Error()})
 		return
 	}
-	writer.WriteHeader(http.StatusNoContent)
+	writeJSON(writer, http.StatusOK, resetResponse{Reset: reset})
 }
 
-func parseHeaderXForwardedFor(headers http.Header) (net.IP, error) {
-	header, ok := headers["X-Forwarded-For"]
-	if !ok || len(header) == 0 {
-		return nil, errors.New("bad request : empty X-Forwarded-For header")
-	}
-	ipv4 := net.ParseIP(header[0]).To4()
-	if ipv4 == nil {
-		return nil, errors.New("bad request : invalid X-Forwarded-For header value - expected IPv4 address")
-	}
-	return ipv4, nil
+// forwardAuthHandler answers nginx auth_request and Traefik ForwardAuth subrequests:
+// 204 if the client is allowed, 429 with Retry-After otherwise. The client ip is taken from
+// X-Original-Forwarded-For (ingress-nginx) if present, from the configured sources otherwise.
+// Note that nginx auth_request treats any status except 2xx, 401 and 403 as an error,
+// so 429 should be mapped with error_page there.
+func (s *Server) forwardAuthHandler() http.Handler {
+	limiter := middleware.New(
+		middleware.WithChecker(s.service),
+		middleware.WithClock(s.service.Clock),
+		middleware.WithKeyFunc(s.forwardAuthIp.ClientIp),
+		middleware.WithDeniedHandler(func(writer http.ResponseWriter, request *http.Request, quota store.Quota) {
+			writer.WriteHeader(http.StatusTooManyRequests)
+		}),
+	)
+	return limiter(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	}))
 }
 
 func (s *Server) mainHandler(fs http.Handler) func(http.ResponseWriter, *http.Request) {
+	limiter := middleware.New(
+		middleware.WithChecker(s.service),
+		middleware.WithClock(s.service.Clock),
+		middleware.WithKeyFunc(s.clientIp.ClientIp),
+		middleware.WithDeniedHandler(s.tooManyRequestsHandler),
+	)
+	protected := limiter(fs)
+
 	return func(writer http.ResponseWriter, request *http.Request) {
-		if request.RequestURI != "/" {
+		if s.config.Upstream == "" && request.RequestURI != "/" {
 			writer.WriteHeader(http.StatusNotFound)
 			return
 		}
+		protected.ServeHTTP(writer, request)
+	}
+}
 
-		ipv4, err := parseHeaderXForwardedFor(request.Header)
-		if err != nil {
-			writer.WriteHeader(http.StatusBadRequest)
-			writer.Write([]byte(err.Error()))
-			return
-		}
-
-		isBlocked, err := s.service.IsLimitExceededForIp(ipv4)
-		if err != nil {
-			writer.WriteHeader(http.StatusInternalServerError)
-			writer.Write([]byte(err.Error()))
-			return
-		}
-
-		if isBlocked {
-			writer.WriteHeader(http.StatusTooManyRequests)
-			err = ToManyReqTemplate.Execute(writer, struct {
-				RequestLimit int
-				Minutes      time.Duration
-			}{
-				RequestLimit: s.config.RequestLimit,
-				Minutes:      s.config.TimeInterval,
-			})
-			if err != nil {
-				log.Println(err.Error())
-			}
-			return
-		}
-		fs.ServeHTTP(writer, request)
+func (s *Server) tooManyRequestsHandler(writer http.ResponseWriter, request *http.Request, quota store.Quota) {
+	writer.WriteHeader(http.StatusTooManyRequests)
+	err := ToManyReqTemplate.Execute(writer, struct {
+		RequestLimit int
+		Minutes      time.Duration
+	}{
+		RequestLimit: s.config.RequestLimit,
+		Minutes:      s.config.TimeInterval,
+	})
+	if err != nil {
+		log.Println(err.Error())
 	}
 }
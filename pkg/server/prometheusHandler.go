@@ -21,6 +21,17 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 var totalRequests = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "http_requests_total",
@@ -42,9 +53,17 @@ var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Help: "Duration of HTTP requests.",
 }, []string{"path"})
 
-func prometheusMiddleware(next http.HandlerFunc) http.Handler {
+// routeProxy labels the requests proxied to the upstream
+const routeProxy = "proxy"
+
+// routeForwardAuth labels the requests to the forward-auth endpoint, whatever its path is
+const routeForwardAuth = "forward_auth"
+
+// prometheusMiddleware measures the requests labeled by the route they are served by. The request URI
+// is never a label, otherwise every path and query of the clients would add series.
+func prometheusMiddleware(route string, next http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.RequestURI()
+		path := route
 
 		timer := prometheus.NewTimer(httpDuration.WithLabelValues(path))
 		rw := NewResponseWriter(w)
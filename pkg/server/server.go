@@ -1,48 +1,176 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
 	"github.com/asavt7/antibot-developer-trainee/pkg/service"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pires/go-proxyproto"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"time"
 )
 
+// defaultTimeout is the read and write timeout of the servers if the config does not set one
+const defaultTimeout = 10 * time.Second
+
 type Server struct {
 	http.Server
 	service        *service.Service
 	toManyReqTempl template.Template
 	config         configs.Config
+	trustedProxies TrustedProxies
+	clientIp       *ClientIpExtractor
+	forwardAuthIp  *ClientIpExtractor
+	// adminNonces of the signed admin requests already accepted
+	adminNonces seenNonces
+	// Admin serves the admin endpoints on config.AdminPort, nil if they are served by Server.
+	Admin *http.Server
 }
 
+// NewServer creates the server protecting protectedHandler, if config.Upstream is set
+// the requests are proxied to the upstream instead.
 func NewServer(config configs.Config, service *service.Service, protectedHandler http.Handler) *Server {
 	mux := http.NewServeMux()
 
-	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", config.Port),
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+	if config.Upstream != "" {
+		upstream, err := url.Parse(config.Upstream)
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		protectedHandler = newReverseProxy(upstream)
+	}
+
+	trustedProxies, err := configs.ParseCIDRs(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	if len(config.IpSources) == 0 {
+		config.IpSources = configs.SplitList(configs.DefaultIpSources)
+	}
+	ipSources, err := ParseIpSources(config.IpSources)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	// ingress-nginx passes the original chain to the auth endpoint in X-Original-Forwarded-For
+	forwardAuthIpSources := append([]IpSource{ForwardedForSource("X-Original-Forwarded-For")}, ipSources...)
+
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = defaultTimeout
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = defaultTimeout
 	}
 
 	s := &Server{
-		Server:  *server,
-		service: service,
-		config:  config,
+		Server: http.Server{
+			Addr:              fmt.Sprintf(":%d", config.Port),
+			Handler:           mux,
+			ReadHeaderTimeout: config.ReadTimeout,
+			ReadTimeout:       config.ReadTimeout,
+			WriteTimeout:      config.WriteTimeout,
+		},
+		service:        service,
+		config:         config,
+		trustedProxies: trustedProxies,
+		clientIp:       NewClientIpExtractor(trustedProxies, ipSources...),
+		forwardAuthIp:  NewClientIpExtractor(trustedProxies, forwardAuthIpSources...),
+	}
+	if config.Upstream != "" {
+		// proxied uploads and streamed responses, e.g. SSE or long polls, may take any time
+		s.ReadTimeout = 0
+		s.WriteTimeout = 0
+		s.IdleTimeout = config.ReadTimeout
 	}
 
-	mux.HandleFunc("/reset", prometheusMiddleware(s.resetHandler).ServeHTTP)
-	mux.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
-	mux.HandleFunc("/", prometheusMiddleware(s.mainHandler(protectedHandler)).ServeHTTP)
+	adminMux := mux
+	if config.AdminPort != 0 {
+		adminMux = http.NewServeMux()
+		s.Admin = &http.Server{
+			Addr:         fmt.Sprintf(":%d", config.AdminPort),
+			Handler:      adminMux,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+		}
+	}
+
+	if config.ForwardAuthPath != "" {
+		mux.HandleFunc(config.ForwardAuthPath, prometheusMiddleware(routeForwardAuth, s.forwardAuthHandler().ServeHTTP).ServeHTTP)
+	}
+	s.registerAdminHandlers(adminMux)
+	mainRoute := "/"
+	if config.Upstream != "" {
+		mainRoute = routeProxy
+	}
+	mux.HandleFunc("/", prometheusMiddleware(mainRoute, s.mainHandler(protectedHandler)).ServeHTTP)
 
 	return s
 }
 
+// RunServer serves the requests until the server is shut down, the admin server is started in the background.
 func (s *Server) RunServer() error {
-	log.Printf("Starting server at %s", s.Addr)
-	err := s.ListenAndServe()
-	return err
+	if s.Admin != nil {
+		adminListener, err := net.Listen("tcp", s.Admin.Addr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Starting admin server at %s", adminListener.Addr())
+		go func() {
+			if err := s.Admin.Serve(adminListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	listener, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting server at %s", listener.Addr())
+	return s.Serve(listener)
+}
+
+// Shutdown gracefully shuts down the server and the admin server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var adminErr error
+	if s.Admin != nil {
+		adminErr = s.Admin.Shutdown(ctx)
+	}
+	return errors.Join(s.Server.Shutdown(ctx), adminErr)
+}
+
+// Listen opens the server listener, if config.ProxyProtocol is set PROXY protocol v1 and v2 headers
+// are accepted from trusted proxies and the conveyed source address becomes the request RemoteAddr.
+func (s *Server) Listen() (net.Listener, error) {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if !s.config.ProxyProtocol {
+		return listener, nil
+	}
+	return &proxyproto.Listener{
+		Listener:          listener,
+		Policy:            s.proxyProtocolPolicy,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+	}, nil
+}
+
+// proxyProtocolPolicy ignores PROXY headers of untrusted peers, otherwise anyone could spoof the source address.
+func (s *Server) proxyProtocolPolicy(upstream net.Addr) (proxyproto.Policy, error) {
+	if tcpAddr, ok := upstream.(*net.TCPAddr); ok && s.trustedProxies.Contains(tcpAddr.IP) {
+		return proxyproto.USE, nil
+	}
+	return proxyproto.IGNORE, nil
+}
+
+// newReverseProxy creates a proxy to the upstream, responses are flushed immediately to support streaming.
+func newReverseProxy(upstream *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.FlushInterval = -1
+	return proxy
 }
@@ -1,18 +1,25 @@
 package server_test
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
 	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
 	"github.com/asavt7/antibot-developer-trainee/pkg/mocks"
 	"github.com/asavt7/antibot-developer-trainee/pkg/server"
 	"github.com/asavt7/antibot-developer-trainee/pkg/service"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -32,14 +39,24 @@ func (m *mockHandler) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 
 var (
 	mockRateLimitService = &mocks.RateLimitCheckerMockService{}
-	mockService          = &service.Service{mockRateLimitService}
+	mockService          = &service.Service{RateLimitChecker: mockRateLimitService, Clock: clock.New()}
 	mockProtectedHandler = &mockHandler{}
-	serv                 = server.NewServer(configs.Config{}, mockService, mockProtectedHandler)
+	testConfig           = configs.Config{TrustedProxies: configs.SplitList(configs.DefaultTrustedProxies), AdminToken: adminToken, ForwardAuthPath: "/auth"}
+	serv                 = server.NewServer(testConfig, mockService, mockProtectedHandler)
 	setupTestCase        = func() {
 		mockProtectedHandler.CallsCount = 0
 	}
 )
 
+func expectHeaders(t *testing.T, header http.Header, expected map[string]string) {
+	t.Helper()
+	for name, value := range expected {
+		if actual := header.Get(name); actual != value {
+			t.Errorf("expected header %s: %q, actual %q", name, value, actual)
+		}
+	}
+}
+
 func TestMainHandler(t *testing.T) {
 	testServ := httptest.NewServer(serv.Handler)
 	defer testServ.Close()
@@ -77,23 +94,36 @@ func TestMainHandler(t *testing.T) {
 		}
 	})
 
-	t.Run("invalid X-Forwarded-For header", func(t *testing.T) {
+	t.Run("ok, IPv6 X-Forwarded-For header", func(t *testing.T) {
+		setupTestCase()
+		var ipArg net.IP
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			ipArg = ip
+			return false, store.Quota{}, nil
+		}
+
 		r, err := http.NewRequest("GET", fmt.Sprintf("%s/", testServ.URL), nil)
 		if err != nil {
 			t.Fatal(err)
 		}
 		r.Header.Set("X-Forwarded-For", "2001:0db8:85a3:0000:0000:8a2e:0370:7334")
 		res, err := testServ.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		if res.StatusCode != http.StatusBadRequest {
-			t.Errorf("expected status 400, actual %d", res.StatusCode)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, actual %d", res.StatusCode)
+		}
+		if !ipArg.Equal(net.ParseIP("2001:db8:85a3::8a2e:370:7334")) {
+			t.Errorf("expected IPv6 address passed to service, actual %s", ipArg)
 		}
 	})
 
 	t.Run("ok, allowed access", func(t *testing.T) {
 		setupTestCase()
-		mockRateLimitService.IsLimitExceededForIpFunc = func(ipv4Addr net.IP) (bool, error) {
-			return false, nil
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return false, store.Quota{Limit: 10, Remaining: 7, ResetAt: time.Now().Add(5 * time.Second)}, nil
 		}
 
 		r, err := http.NewRequest("GET", fmt.Sprintf("%s", testServ.URL), nil)
@@ -121,12 +151,18 @@ func TestMainHandler(t *testing.T) {
 		if mockProtectedHandler.CallsCount < 1 {
 			t.Errorf("static content handler was not called")
 		}
+		expectHeaders(t, res.Header, map[string]string{
+			"RateLimit-Limit":     "10",
+			"RateLimit-Remaining": "7",
+			"RateLimit-Reset":     "5",
+			"Retry-After":         "",
+		})
 	})
 
 	t.Run("subnet blocked", func(t *testing.T) {
 		setupTestCase()
-		mockRateLimitService.IsLimitExceededForIpFunc = func(ipv4Addr net.IP) (bool, error) {
-			return true, nil
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return true, store.Quota{Limit: 10, Remaining: 0, BlockedUntil: time.Now().Add(90 * time.Second)}, nil
 		}
 
 		r, err := http.NewRequest("GET", fmt.Sprintf("%s", testServ.URL), nil)
@@ -142,12 +178,18 @@ func TestMainHandler(t *testing.T) {
 		if mockProtectedHandler.CallsCount > 0 {
 			t.Errorf("static content handler was called, but should not")
 		}
+		expectHeaders(t, res.Header, map[string]string{
+			"Retry-After":         "90",
+			"RateLimit-Limit":     "10",
+			"RateLimit-Remaining": "0",
+			"RateLimit-Reset":     "90",
+		})
 	})
 
 	t.Run("error from service layer", func(t *testing.T) {
 		setupTestCase()
-		mockRateLimitService.IsLimitExceededForIpFunc = func(ipv4Addr net.IP) (bool, error) {
-			return false, errors.New("error")
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return false, store.Quota{}, errors.New("error")
 		}
 
 		r, err := http.NewRequest("GET", fmt.Sprintf("%s", testServ.URL), nil)
@@ -167,80 +209,663 @@ func TestMainHandler(t *testing.T) {
 
 }
 
-func TestResetHandler(t *testing.T)  {
+func TestResetHandler(t *testing.T) {
 
 	testServ := httptest.NewServer(serv.Handler)
 	defer testServ.Close()
 
-	t.Run("no X-Forwarded-For header", func(t *testing.T) {
-		res, err := http.Get(fmt.Sprintf("%s/reset", testServ.URL))
+	reset := func(t *testing.T, method string, query string, body string) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(method, fmt.Sprintf("%s/reset%s", testServ.URL, query), strings.NewReader(body))
 		if err != nil {
 			t.Fatal(err)
 		}
-		if res.StatusCode != http.StatusBadRequest {
+		// the caller's own address is not a target
+		r.Header.Set("X-Forwarded-For", "111.111.111.111")
+		r.Header.Set("Authorization", "Bearer "+adminToken)
+		res, err := testServ.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	t.Run("GET not allowed", func(t *testing.T) {
+		if res := reset(t, "GET", "?target=10.0.0.1", ""); res.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("expected status 405, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("no targets", func(t *testing.T) {
+		if res := reset(t, "POST", "", ""); res.StatusCode != http.StatusBadRequest {
 			t.Errorf("expected status 400, actual %d", res.StatusCode)
 		}
 	})
 
-	t.Run("invalid X-Forwarded-For header", func(t *testing.T) {
-		r, err := http.NewRequest("GET", fmt.Sprintf("%s/reset", testServ.URL), nil)
+	t.Run("invalid body", func(t *testing.T) {
+		if res := reset(t, "POST", "", "qwe"); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		mockRateLimitService.ResetPrefixesFunc = func(targets []string) ([]string, error) {
+			return nil, fmt.Errorf("%w: qwe", service.ErrInvalidTarget)
+		}
+		if res := reset(t, "POST", "?target=qwe", ""); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400, actual %d", res.StatusCode)
+		}
+	})
+
+	t.Run("ok, query and body targets", func(t *testing.T) {
+		var targetsArg []string
+		mockRateLimitService.ResetPrefixesFunc = func(targets []string) ([]string, error) {
+			targetsArg = targets
+			return []string{"10.0.0.0", "2001:db8::"}, nil
+		}
+
+		res := reset(t, "POST", "?target=10.0.0.1&target=198.51.100.0/22", `{"targets": ["2001:db8::1"]}`)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, actual %d", res.StatusCode)
+		}
+		if expected := []string{"10.0.0.1", "198.51.100.0/22", "2001:db8::1"}; !reflect.DeepEqual(targetsArg, expected) {
+			t.Errorf("expected targets %v, actual %v", expected, targetsArg)
+		}
+		var body struct {
+			Reset []string `json:"reset"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"10.0.0.0", "2001:db8::"}; !reflect.DeepEqual(body.Reset, expected) {
+			t.Errorf("expected reset subnets %v, actual %v", expected, body.Reset)
+		}
+	})
+
+	t.Run("error from service layer", func(t *testing.T) {
+		mockRateLimitService.ResetPrefixesFunc = func(targets []string) ([]string, error) {
+			return nil, errors.New("error")
+		}
+		if res := reset(t, "POST", "?target=10.0.0.1", ""); res.StatusCode != http.StatusInternalServerError {
+			t.Errorf("expected status 500, actual %d", res.StatusCode)
+		}
+	})
+
+}
+
+func TestReverseProxyMode(t *testing.T) {
+	streamed := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/stream" {
+			writer.Write([]byte("first chunk"))
+			writer.(http.Flusher).Flush()
+			<-streamed
+			writer.Write([]byte("second chunk"))
+			return
+		}
+		body, _ := ioutil.ReadAll(request.Body)
+		fmt.Fprintf(writer, "%s %s %s", request.Method, request.URL.RequestURI(), body)
+	}))
+	defer upstream.Close()
+
+	mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+		return false, store.Quota{}, nil
+	}
+	proxyServ := server.NewServer(configs.Config{Upstream: upstream.URL, TrustedProxies: testConfig.TrustedProxies}, mockService, mockProtectedHandler)
+	testServ := httptest.NewServer(proxyServ.Handler)
+	defer testServ.Close()
+
+	t.Run("path, query, method and body are preserved", func(t *testing.T) {
+		setupTestCase()
+		r, err := http.NewRequest("POST", fmt.Sprintf("%s/api/items?id=1&sort=desc", testServ.URL), strings.NewReader("payload"))
 		if err != nil {
 			t.Fatal(err)
 		}
-		r.Header.Set("X-Forwarded-For", "qwe.qwe.qwe.123")
+		r.Header.Set("X-Forwarded-For", "111.111.111.111")
 		res, err := testServ.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		if res.StatusCode != http.StatusBadRequest {
-			t.Errorf("expected status 400, actual %d", res.StatusCode)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, actual %d", res.StatusCode)
+		}
+		if string(body) != "POST /api/items?id=1&sort=desc payload" {
+			t.Errorf("unexpected upstream response : %s", body)
+		}
+		if mockProtectedHandler.CallsCount > 0 {
+			t.Errorf("static content handler was called, but should not")
 		}
 	})
 
-	t.Run("invalid X-Forwarded-For header", func(t *testing.T) {
-		r, err := http.NewRequest("GET", fmt.Sprintf("%s/reset", testServ.URL), nil)
+	t.Run("auth path is proxied without forward-auth", func(t *testing.T) {
+		r, err := http.NewRequest("GET", fmt.Sprintf("%s/auth?next=/", testServ.URL), nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-		r.Header.Set("X-Forwarded-For", "2001:0db8:85a3:0000:0000:8a2e:0370:7334")
+		r.Header.Set("X-Forwarded-For", "111.111.111.111")
 		res, err := testServ.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		if res.StatusCode != http.StatusBadRequest {
-			t.Errorf("expected status 400, actual %d", res.StatusCode)
+		if res.StatusCode != http.StatusOK || string(body) != "GET /auth?next=/ " {
+			t.Errorf("expected request proxied to upstream, actual %d %s", res.StatusCode, body)
 		}
 	})
 
-	t.Run("ok", func(t *testing.T) {
-		setupTestCase()
-		mockRateLimitService.ResetPrefixForIpv4Func = func(ipv4Addr net.IP) error {
-			return nil
+	t.Run("response is streamed", func(t *testing.T) {
+		r, err := http.NewRequest("GET", fmt.Sprintf("%s/stream", testServ.URL), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Forwarded-For", "111.111.111.111")
+		res, err := testServ.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
 		}
+		defer res.Body.Close()
 
-		r, err := http.NewRequest("GET", fmt.Sprintf("%s/reset", testServ.URL), nil)
+		chunk := make([]byte, len("first chunk"))
+		if _, err := io.ReadFull(res.Body, chunk); err != nil {
+			t.Fatal(err)
+		}
+		close(streamed)
+		rest, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(chunk)+string(rest) != "first chunksecond chunk" {
+			t.Errorf("unexpected upstream response : %s%s", chunk, rest)
+		}
+	})
+
+	t.Run("streamed longer than server timeouts", func(t *testing.T) {
+		const timeout = 100 * time.Millisecond
+		slowUpstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			body, err := io.ReadAll(request.Body)
+			if err != nil {
+				t.Errorf("reading upload: %v", err)
+			}
+			fmt.Fprintf(writer, "received %s;", body)
+			writer.(http.Flusher).Flush()
+			time.Sleep(3 * timeout)
+			writer.Write([]byte("done"))
+		}))
+		defer slowUpstream.Close()
+
+		slowServ := server.NewServer(configs.Config{
+			Upstream:       slowUpstream.URL,
+			TrustedProxies: testConfig.TrustedProxies,
+			ReadTimeout:    timeout,
+			WriteTimeout:   timeout,
+		}, mockService, mockProtectedHandler)
+		listener, err := slowServ.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go slowServ.Serve(listener)
+		defer slowServ.Close()
+
+		upload, uploadWriter := io.Pipe()
+		go func() {
+			uploadWriter.Write([]byte("slow "))
+			time.Sleep(3 * timeout)
+			uploadWriter.Write([]byte("upload"))
+			uploadWriter.Close()
+		}()
+		r, err := http.NewRequest("POST", fmt.Sprintf("http://%s/events", listener.Addr()), upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Forwarded-For", "111.111.111.111")
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("response cut off after %q: %v", body, err)
+		}
+		if string(body) != "received slow upload;done" {
+			t.Errorf("unexpected upstream response : %s", body)
+		}
+	})
+
+	t.Run("metrics labeled by route", func(t *testing.T) {
+		res, err := http.Get(fmt.Sprintf("%s/metrics", testServ.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		metrics, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(metrics), `http_requests_total{path="proxy"}`) {
+			t.Errorf("expected proxied requests counted by route")
+		}
+		if strings.Contains(string(metrics), "/api/items") {
+			t.Errorf("expected no series of proxied paths")
+		}
+	})
+
+	t.Run("subnet blocked", func(t *testing.T) {
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return true, store.Quota{}, nil
+		}
+		r, err := http.NewRequest("GET", fmt.Sprintf("%s/api/items", testServ.URL), nil)
 		if err != nil {
 			t.Fatal(err)
 		}
 		r.Header.Set("X-Forwarded-For", "111.111.111.111")
 		res, err := testServ.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected status 429, actual %d", res.StatusCode)
+		}
+	})
+}
+
+// newNginxAuthRequest emulates the subrequest nginx auth_request sends to the auth endpoint
+func newNginxAuthRequest(t *testing.T, url string, headers map[string]string) *http.Request {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Original-URI", "/protected/page?id=1")
+	r.Header.Set("X-Original-Method", "POST")
+	r.Header.Set("Content-Length", "")
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+func TestForwardAuthHandler(t *testing.T) {
+	testServ := httptest.NewServer(serv.Handler)
+	defer testServ.Close()
+	authUrl := fmt.Sprintf("%s/auth", testServ.URL)
+
+	t.Run("no client ip headers", func(t *testing.T) {
+		res, err := testServ.Client().Do(newNginxAuthRequest(t, authUrl, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400, actual %d", res.StatusCode)
+		}
+	})
 
+	t.Run("allowed", func(t *testing.T) {
+		var ipArg net.IP
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			ipArg = ip
+			return false, store.Quota{Limit: 10, Remaining: 3, ResetAt: time.Now().Add(4 * time.Second)}, nil
+		}
+
+		res, err := testServ.Client().Do(newNginxAuthRequest(t, authUrl, map[string]string{"X-Forwarded-For": "111.111.111.111"}))
+		if err != nil {
+			t.Fatal(err)
+		}
 		if res.StatusCode != http.StatusNoContent {
 			t.Errorf("expected status 204, actual %d", res.StatusCode)
 		}
+		if !ipArg.Equal(net.ParseIP("111.111.111.111")) {
+			t.Errorf("expected ip from X-Forwarded-For, actual %s", ipArg)
+		}
+		expectHeaders(t, res.Header, map[string]string{
+			"RateLimit-Limit":     "10",
+			"RateLimit-Remaining": "3",
+			"RateLimit-Reset":     "4",
+			"Retry-After":         "",
+		})
 	})
-	t.Run("error from service layer", func(t *testing.T) {
-		setupTestCase()
-		mockRateLimitService.ResetPrefixForIpv4Func = func(ipv4Addr net.IP)  error {
-			return errors.New("error")
+
+	t.Run("X-Original-Forwarded-For takes precedence", func(t *testing.T) {
+		var ipArg net.IP
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			ipArg = ip
+			return false, store.Quota{}, nil
 		}
 
-		r, err := http.NewRequest("GET", fmt.Sprintf("%s/reset", testServ.URL), nil)
+		res, err := testServ.Client().Do(newNginxAuthRequest(t, authUrl, map[string]string{
+			"X-Forwarded-For":          "10.0.0.1",
+			"X-Original-Forwarded-For": "2001:db8::1",
+		}))
 		if err != nil {
 			t.Fatal(err)
 		}
-		r.Header.Set("X-Forwarded-For", "111.111.111.111")
-		res, err := testServ.Client().Do(r)
+		if res.StatusCode != http.StatusNoContent {
+			t.Errorf("expected status 204, actual %d", res.StatusCode)
+		}
+		if !ipArg.Equal(net.ParseIP("2001:db8::1")) {
+			t.Errorf("expected ip from X-Original-Forwarded-For, actual %s", ipArg)
+		}
+	})
 
+	t.Run("denied", func(t *testing.T) {
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return true, store.Quota{Limit: 10, BlockedUntil: time.Now().Add(30 * time.Second)}, nil
+		}
+
+		res, err := testServ.Client().Do(newNginxAuthRequest(t, authUrl, map[string]string{"X-Forwarded-For": "111.111.111.111"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected status 429, actual %d", res.StatusCode)
+		}
+		expectHeaders(t, res.Header, map[string]string{"Retry-After": "30"})
+	})
+
+	t.Run("error from service layer", func(t *testing.T) {
+		mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+			return false, store.Quota{}, errors.New("error")
+		}
+
+		res, err := testServ.Client().Do(newNginxAuthRequest(t, authUrl, map[string]string{"X-Forwarded-For": "111.111.111.111"}))
+		if err != nil {
+			t.Fatal(err)
+		}
 		if res.StatusCode != http.StatusInternalServerError {
 			t.Errorf("expected status 500, actual %d", res.StatusCode)
 		}
 	})
+}
 
-}
\ No newline at end of file
+func TestClientIp(t *testing.T) {
+	testTable := []struct {
+		name           string
+		trustedProxies []string
+		ipSources      []string
+		remoteAddr     string
+		headers        map[string][]string
+		expectedStatus int
+		expectedIp     string
+	}{
+		{
+			name:           "single address",
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"111.111.111.111"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "111.111.111.111",
+		},
+		{
+			name:           "chain with trusted proxy",
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"111.111.111.111, 10.0.0.2"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "111.111.111.111",
+		},
+		{
+			name:           "spoofed first hop is skipped",
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"6.6.6.6, 111.111.111.111", "10.0.0.2"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "111.111.111.111",
+		},
+		{
+			name:           "whole chain trusted",
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"192.168.1.1,10.0.0.2"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "192.168.1.1",
+		},
+		{
+			name:           "ipv6 chain",
+			remoteAddr:     "[::1]:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"2001:db8::1, fd00::1"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "2001:db8::1",
+		},
+		{
+			name:           "header of untrusted peer is ignored",
+			remoteAddr:     "222.222.222.222:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"111.111.111.111"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "222.222.222.222",
+		},
+		{
+			name:           "no header, untrusted peer",
+			remoteAddr:     "222.222.222.222:1234",
+			expectedStatus: http.StatusOK,
+			expectedIp:     "222.222.222.222",
+		},
+		{
+			name:           "no header, trusted peer",
+			remoteAddr:     "10.0.0.1:1234",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid hop",
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"111.111.111.111, qwe"}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "forwarded header",
+			ipSources:      []string{"forwarded", "remote-addr"},
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"Forwarded": {`for=192.0.2.60;proto=http;by=203.0.113.43, for=10.0.0.2`}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "192.0.2.60",
+		},
+		{
+			name:           "forwarded header, quoted ipv6 with port",
+			ipSources:      []string{"forwarded"},
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"Forwarded": {`For="[2001:db8:cafe::17]:4711"`, `for="10.0.0.2:80";by="_proxy"`}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "2001:db8:cafe::17",
+		},
+		{
+			name:           "forwarded header, unknown client falls back to next source",
+			ipSources:      []string{"forwarded", "x-forwarded-for"},
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"Forwarded": {`for=unknown`}, "X-Forwarded-For": {"111.111.111.111"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "111.111.111.111",
+		},
+		{
+			name:           "forwarded header, unknown client without other source",
+			ipSources:      []string{"forwarded"},
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"Forwarded": {`for="unknown:4711"`}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "forwarded header, obfuscated client behind trusted proxy",
+			ipSources:      []string{"forwarded"},
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"Forwarded": {`for=192.0.2.60, for="_hidden:_port", for=10.0.0.2`}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "10.0.0.2",
+		},
+		{
+			name:           "unknown client behind trusted proxy",
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"unknown, 10.0.0.2"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "10.0.0.2",
+		},
+		{
+			name:           "obfuscated client falls back to next source",
+			ipSources:      []string{"x-forwarded-for", "x-real-ip"},
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"_obf"}, "X-Real-Ip": {"111.111.111.111"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "111.111.111.111",
+		},
+		{
+			name:           "sources order, forwarded absent",
+			ipSources:      []string{"forwarded", "x-real-ip", "x-forwarded-for"},
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Real-Ip": {"111.111.111.111"}, "X-Forwarded-For": {"222.222.222.222"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "111.111.111.111",
+		},
+		{
+			name:           "x-real-ip of untrusted peer is ignored",
+			ipSources:      []string{"x-real-ip", "remote-addr"},
+			remoteAddr:     "222.222.222.222:1234",
+			headers:        map[string][]string{"X-Real-Ip": {"111.111.111.111"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "222.222.222.222",
+		},
+		{
+			name:           "remote addr only",
+			ipSources:      []string{"remote-addr"},
+			remoteAddr:     "[2001:db8::1]:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"111.111.111.111"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "2001:db8::1",
+		},
+		{
+			name:           "nothing trusted",
+			trustedProxies: []string{},
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"111.111.111.111"}},
+			expectedStatus: http.StatusOK,
+			expectedIp:     "10.0.0.1",
+		},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			var ipArg net.IP
+			mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+				ipArg = ip
+				return false, store.Quota{}, nil
+			}
+			trustedProxies := testConfig.TrustedProxies
+			if tc.trustedProxies != nil {
+				trustedProxies = tc.trustedProxies
+			}
+			testServ := server.NewServer(configs.Config{TrustedProxies: trustedProxies, IpSources: tc.ipSources}, mockService, mockProtectedHandler)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for name, values := range tc.headers {
+				r.Header[name] = values
+			}
+			res := httptest.NewRecorder()
+			testServ.Handler.ServeHTTP(res, r)
+
+			if res.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, actual %d", tc.expectedStatus, res.Code)
+			}
+			if tc.expectedIp != "" && !ipArg.Equal(net.ParseIP(tc.expectedIp)) {
+				t.Errorf("expected client ip %s, actual %s", tc.expectedIp, ipArg)
+			}
+		})
+	}
+}
+
+func TestParseIpSources(t *testing.T) {
+	sources, err := server.ParseIpSources([]string{"Forwarded", "x-forwarded-for", "x-real-ip", "remote-addr"})
+	if err != nil || len(sources) != 4 {
+		t.Errorf("expected 4 sources, actual %d, error %v", len(sources), err)
+	}
+	if _, err := server.ParseIpSources([]string{"cookie"}); err == nil {
+		t.Errorf("expected error for unknown source")
+	}
+}
+
+func proxyProtocolV2Header(src net.IP, dst net.IP, srcPort uint16, dstPort uint16) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x21, 0x21, 0, 36) // v2 PROXY, TCP over IPv6, address length
+	header = append(header, src.To16()...)
+	header = append(header, dst.To16()...)
+	header = append(header, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	return header
+}
+
+func TestProxyProtocol(t *testing.T) {
+	testTable := []struct {
+		name           string
+		trustedProxies []string
+		header         []byte
+		expectedIp     string
+	}{
+		{
+			name:           "v1",
+			trustedProxies: testConfig.TrustedProxies,
+			header:         []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 80\r\n"),
+			expectedIp:     "203.0.113.7",
+		},
+		{
+			name:           "v2",
+			trustedProxies: testConfig.TrustedProxies,
+			header:         proxyProtocolV2Header(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1"), 56324, 80),
+			expectedIp:     "2001:db8::7",
+		},
+		{
+			name:           "no header",
+			trustedProxies: []string{"10.0.0.0/8"},
+			expectedIp:     "127.0.0.1",
+		},
+		{
+			name:           "header of untrusted peer is ignored",
+			trustedProxies: []string{"10.0.0.0/8"},
+			header:         []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 80\r\n"),
+			expectedIp:     "127.0.0.1",
+		},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			var ipArg net.IP
+			mockRateLimitService.IsLimitExceededForIpFunc = func(ip net.IP) (bool, store.Quota, error) {
+				ipArg = ip
+				return false, store.Quota{}, nil
+			}
+			proxyServ := server.NewServer(configs.Config{
+				ProxyProtocol:  true,
+				TrustedProxies: tc.trustedProxies,
+				IpSources:      []string{"remote-addr"},
+			}, mockService, mockProtectedHandler)
+			listener, err := proxyServ.Listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go proxyServ.Serve(listener)
+			defer proxyServ.Close()
+
+			port := listener.Addr().(*net.TCPAddr).Port
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			request := append(tc.header, []byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")...)
+			if _, err := conn.Write(request); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("expected status 200, actual %d", res.StatusCode)
+			}
+			if !ipArg.Equal(net.ParseIP(tc.expectedIp)) {
+				t.Errorf("expected client ip %s, actual %s", tc.expectedIp, ipArg)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"errors"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"net"
+)
+
+// ErrDenied is returned for the ips of the deny list.
+var ErrDenied = errors.New("ip is denied by access list")
+
+type access int
+
+const (
+	accessNone access = iota
+	accessAllow
+	accessDeny
+)
+
+// accessList is the static allow and deny lists of networks joined with the entries added at runtime.
+// The most specific network containing the ip wins, so that an office network can be allowed
+// within a denied range and the other way round. Deny wins between equal ones.
+type accessList struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	runtime store.AccessListStore
+}
+
+func (a accessList) check(ip net.IP) (access, error) {
+	allow := longestMatch(a.allow, ip)
+	deny := longestMatch(a.deny, ip)
+	var entries []store.AccessEntry
+	if a.runtime != nil {
+		var err error
+		if entries, err = a.runtime.Lookup(ip); err != nil {
+			return accessNone, err
+		}
+	}
+	for _, entry := range entries {
+		network, err := entry.Network()
+		if err != nil {
+			continue
+		}
+		ones, _ := network.Mask.Size()
+		switch entry.List {
+		case store.AccessAllow:
+			allow = max(allow, ones)
+		case store.AccessDeny:
+			deny = max(deny, ones)
+		}
+	}
+	switch {
+	case deny >= 0 && deny >= allow:
+		return accessDeny, nil
+	case allow >= 0:
+		return accessAllow, nil
+	}
+	return accessNone, nil
+}
+
+// longestMatch returns the prefix length of the most specific network containing the ip, -1 if there is none
+func longestMatch(networks []*net.IPNet, ip net.IP) int {
+	longest := -1
+	for _, network := range networks {
+		if network.Contains(ip) {
+			if ones, _ := network.Mask.Size(); ones > longest {
+				longest = ones
+			}
+		}
+	}
+	return longest
+}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
 	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
 	"github.com/asavt7/antibot-developer-trainee/pkg/store"
 	"log"
@@ -10,74 +12,179 @@ import (
 )
 
 type RateLimitChecker interface {
-	IsLimitExceededForIp(ipv4Addr net.IP) (bool, error)
-	ResetPrefixForIpv4(ipv4Addr net.IP) error
+	// IsLimitExceededForIp counts the request of the ip and reports whether its subnet exceeded the limit.
+	// Ips of the allow list are not counted and get zero quota, ips of the deny list get ErrDenied.
+	IsLimitExceededForIp(ip net.IP) (bool, store.Quota, error)
+	// ResetPrefixes resets the subnets of the targets, each an ip or a CIDR, and returns the subnets that were tracked.
+	// A CIDR wider than the prefix size resets every tracked subnet within it, otherwise the subnet containing it.
+	// Nothing is reset if any target is invalid, the error wraps ErrInvalidTarget then.
+	ResetPrefixes(targets []string) ([]string, error)
 }
 
+// ErrInvalidTarget is returned for reset targets that are neither an ip nor a CIDR.
+var ErrInvalidTarget = errors.New("invalid reset target")
+
 type Service struct {
 	RateLimitChecker
+	// AccessList keeps the allow and deny list entries added at runtime, nil if they can not be managed.
+	AccessList store.AccessListStore
+	// Store is the rate limit store inspected by the admin API, nil if it is not available.
+	Store store.RateLimitStore
+	// Clock is the time the quotas are computed at, the rate limit headers are rendered with it.
+	Clock clock.Clock
 }
 
 type RateLimitCheckerImpl struct {
-	prefixSize  int
-	mask        net.IPMask
-	limit       int
-	waitingTime time.Duration
-	store       store.RateLimitStore
+	prefixSize   int
+	mask         net.IPMask
+	prefixSizeV6 int
+	maskV6       net.IPMask
+	limit        int
+	waitingTime  time.Duration
+	store        store.RateLimitStore
+	access       accessList
+	clock        clock.Clock
 }
 
-func parseSubnetSizeToMask(size int) (net.IPMask, error) {
-	if size > 32 || size < 0 {
+func parseSubnetSizeToMask(size int, bits int) (net.IPMask, error) {
+	if size > bits || size < 0 {
 		return nil, errors.New("Incorrect subnet size")
 	}
+	return net.CIDRMask(size, bits), nil
+}
 
-	res := make([]byte, 4)
-	for i := 1; i < 5; i++ {
-		if size/8 >= i {
-			res[i-1] = 255
-			continue
-		} else {
-			if (size - i*8) >= 0 {
-				res[i-1] = byte(size - i*8)
-			} else {
-				res[i-1] = 0
-			}
-		}
-	}
-	return net.IPv4Mask(res[0], res[1], res[2], res[3]), nil
+// NewServiceImpl creates the service limiting requests with the store, runtime access list entries are kept in memory.
+func NewServiceImpl(conf configs.Config, rateLimitStore store.RateLimitStore, clk clock.Clock) *Service {
+	return NewServiceWithAccessList(conf, rateLimitStore, store.NewInMemoryAccessListStore(clk), clk)
 }
 
-func NewServiceImpl(conf configs.Config, store store.RateLimitStore) *Service {
-	mask, err := parseSubnetSizeToMask(conf.PrefixSize)
+// NewServiceWithAccessList creates the service checking the ips against the runtime entries of accessListStore
+// in addition to the static lists of conf. A nil accessListStore is an empty list that can not be managed.
+func NewServiceWithAccessList(conf configs.Config, rateLimitStore store.RateLimitStore, accessListStore store.AccessListStore, clk clock.Clock) *Service {
+	mask, err := parseSubnetSizeToMask(conf.PrefixSize, 8*net.IPv4len)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	maskV6, err := parseSubnetSizeToMask(conf.PrefixSizeV6, 8*net.IPv6len)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	allow, err := configs.ParseCIDRs(conf.AllowList)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	deny, err := configs.ParseCIDRs(conf.DenyList)
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
 	return &Service{
-		&RateLimitCheckerImpl{prefixSize: conf.PrefixSize, limit: conf.RequestLimit, mask: mask, waitingTime: conf.BlockingTimeout, store: store},
+		RateLimitChecker: &RateLimitCheckerImpl{
+			prefixSize:   conf.PrefixSize,
+			mask:         mask,
+			prefixSizeV6: conf.PrefixSizeV6,
+			maskV6:       maskV6,
+			limit:        conf.RequestLimit,
+			waitingTime:  conf.BlockingTimeout,
+			store:        rateLimitStore,
+			access:       accessList{allow: allow, deny: deny, runtime: accessListStore},
+			clock:        clk,
+		},
+		AccessList: accessListStore,
+		Store:      rateLimitStore,
+		Clock:      clk,
 	}
 }
 
-func (s *RateLimitCheckerImpl) IsLimitExceededForIp(ipv4Addr net.IP) (bool, error) {
-	subnet, err := s.parseIpToSubnet(ipv4Addr)
+func (s *RateLimitCheckerImpl) IsLimitExceededForIp(ip net.IP) (bool, store.Quota, error) {
+	subnet, err := s.parseIpToSubnet(ip)
+	if err != nil {
+		return false, store.Quota{}, err
+	}
+	access, err := s.access.check(ip)
+	if err != nil {
+		return false, store.Quota{}, err
+	}
+	switch access {
+	case accessDeny:
+		return false, store.Quota{}, ErrDenied
+	case accessAllow:
+		return false, store.Quota{}, nil
+	}
+	decision, err := s.store.Take(subnet)
 	if err != nil {
-		return false, err
+		return false, store.Quota{}, err
 	}
-	isBlocked := s.store.Check(subnet)
-	return isBlocked, nil
+	if !decision.Allowed && decision.RetryAfter <= 0 {
+		// the store may not know the blocking time
+		decision.RetryAfter = s.waitingTime
+	}
+	return !decision.Allowed, decision.Quota(s.clock.Now()), nil
 }
 
-
-func (s *RateLimitCheckerImpl) ResetPrefixForIpv4(ipv4Addr net.IP) error {
-	subnet, err := s.parseIpToSubnet(ipv4Addr)
+func (s *RateLimitCheckerImpl) ResetPrefixes(targets []string) ([]string, error) {
+	networks, err := configs.ParseCIDRs(targets)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+
+	var subnets []string
+	seen := make(map[string]bool)
+	add := func(subnet string) {
+		if !seen[subnet] {
+			seen[subnet] = true
+			subnets = append(subnets, subnet)
+		}
 	}
-	s.store.Reset(subnet)
-	return nil
+	// the tracked subnets are listed once for all the wide networks
+	var tracked []store.SubnetState
+	for _, network := range networks {
+		ones, bits := network.Mask.Size()
+		prefixSize := s.prefixSize
+		if bits == 8*net.IPv6len {
+			prefixSize = s.prefixSizeV6
+		}
+		if ones >= prefixSize {
+			subnet, err := s.parseIpToSubnet(network.IP)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+			}
+			add(subnet)
+			continue
+		}
+		if tracked == nil {
+			if tracked, err = s.store.Subnets(); err != nil {
+				return nil, err
+			}
+		}
+		for _, state := range tracked {
+			if network.Contains(net.ParseIP(state.Subnet)) {
+				add(state.Subnet)
+			}
+		}
+	}
+
+	reset := []string{}
+	for _, subnet := range subnets {
+		ok, err := s.store.Reset(subnet)
+		if err != nil {
+			return reset, err
+		}
+		if ok {
+			reset = append(reset, subnet)
+		}
+	}
+	return reset, nil
 }
 
+// parseIpToSubnet masks the ip with the prefix of its address family,
+// IPv4-mapped IPv6 addresses are treated as IPv4.
 func (s *RateLimitCheckerImpl) parseIpToSubnet(ip net.IP) (string, error) {
-	subnetIp := ip.Mask(s.mask)
+	var subnetIp net.IP
+	if ipv4 := ip.To4(); ipv4 != nil {
+		subnetIp = ipv4.Mask(s.mask)
+	} else if len(ip) == net.IPv6len {
+		subnetIp = ip.Mask(s.maskV6)
+	}
 	if subnetIp == nil {
 		return "", errors.New("invalid ip provided")
 	}
@@ -1,69 +1,105 @@
 package service
 
 import (
+	"errors"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
 	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
 	"github.com/asavt7/antibot-developer-trainee/pkg/mocks"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 var (
 	conf = configs.Config{
-		PrefixSize: 24,
+		PrefixSize:   24,
+		PrefixSizeV6: 64,
 	}
 	rateLimitStoreMock = &mocks.RateLimitStoreMock{}
-	service            = NewServiceImpl(conf, rateLimitStoreMock)
+	service            = NewServiceImpl(conf, rateLimitStoreMock, clock.New())
 )
 
 func TestRateLimitCheckerImpl_IsLimitExceededForIp(t *testing.T) {
 	testTable := []struct {
 		name           string
 		prefixSize     int
-		ipv4           net.IP
+		prefixSizeV6   int
+		ip             net.IP
 		expectedSubnet string
 	}{
 		{
 			name:           "111.111.111.111",
 			prefixSize:     24,
-			ipv4:           net.ParseIP("111.111.111.111"),
+			ip:             net.ParseIP("111.111.111.111"),
 			expectedSubnet: "111.111.111.0",
 		},
 		{
 			name:           "222.222.222.123",
 			prefixSize:     24,
-			ipv4:           net.ParseIP("222.222.222.123"),
+			ip:             net.ParseIP("222.222.222.123"),
 			expectedSubnet: "222.222.222.0",
 		},
 		{
 			name:           "222.222.222.123",
 			prefixSize:     32,
-			ipv4:           net.ParseIP("222.222.222.123"),
+			ip:             net.ParseIP("222.222.222.123"),
 			expectedSubnet: "222.222.222.123",
 		},
 		{
 			name:           "222.222.222.123",
 			prefixSize:     8,
-			ipv4:           net.ParseIP("222.222.222.123"),
+			ip:             net.ParseIP("222.222.222.123"),
 			expectedSubnet: "222.0.0.0",
 		},
+		{
+			name:           "IPv4-mapped IPv6 ::ffff:222.222.222.123",
+			prefixSize:     24,
+			ip:             net.ParseIP("::ffff:222.222.222.123"),
+			expectedSubnet: "222.222.222.0",
+		},
+		{
+			name:           "2001:db8:85a3:1234:0:8a2e:370:7334/64",
+			prefixSizeV6:   64,
+			ip:             net.ParseIP("2001:db8:85a3:1234:0:8a2e:370:7334"),
+			expectedSubnet: "2001:db8:85a3:1234::",
+		},
+		{
+			name:           "2001:db8:85a3:1234:0:8a2e:370:7334/56",
+			prefixSizeV6:   56,
+			ip:             net.ParseIP("2001:db8:85a3:1234:0:8a2e:370:7334"),
+			expectedSubnet: "2001:db8:85a3:1200::",
+		},
+		{
+			name:           "2001:db8:85a3:1234:0:8a2e:370:7334/128",
+			prefixSizeV6:   128,
+			ip:             net.ParseIP("2001:db8:85a3:1234:0:8a2e:370:7334"),
+			expectedSubnet: "2001:db8:85a3:1234:0:8a2e:370:7334",
+		},
 	}
 
 	var subnetArg string
-	rateLimitStoreMock.CheckFunc = func(subnet string) bool {
+	rateLimitStoreMock.TakeFunc = func(subnet string) (store.Decision, error) {
 		subnetArg = subnet
-		return false
+		return store.Decision{Allowed: true, Limit: 10, Remaining: 9}, nil
 	}
 
 	for _, tc := range testTable {
 		subnetArg = ""
 		t.Run(tc.name, func(t *testing.T) {
 
-			service = NewServiceImpl(configs.Config{PrefixSize: tc.prefixSize}, rateLimitStoreMock)
+			service = NewServiceImpl(configs.Config{PrefixSize: tc.prefixSize, PrefixSizeV6: tc.prefixSizeV6}, rateLimitStoreMock, clock.New())
 
-			isBlocked, err := service.IsLimitExceededForIp(tc.ipv4)
+			isBlocked, quota, err := service.IsLimitExceededForIp(tc.ip)
 			if err != nil {
 				t.Errorf("expected nil error")
 			}
+			if quota.Remaining != 9 {
+				t.Errorf("expected quota from store, actual %+v", quota)
+			}
 			if isBlocked {
 				t.Errorf("expected false")
 			}
@@ -74,39 +110,214 @@ func TestRateLimitCheckerImpl_IsLimitExceededForIp(t *testing.T) {
 	}
 
 	t.Run("invalid arg", func(t *testing.T) {
-		service = NewServiceImpl(configs.Config{PrefixSize: 24}, rateLimitStoreMock)
-		_, err := service.IsLimitExceededForIp(net.ParseIP("444.444.444.444"))
+		service = NewServiceImpl(configs.Config{PrefixSize: 24}, rateLimitStoreMock, clock.New())
+		_, _, err := service.IsLimitExceededForIp(net.ParseIP("444.444.444.444"))
 		if err == nil {
 			t.Errorf("expected error for invalid ip addr")
 		}
 	})
 
 }
-func TestRateLimitCheckerImpl_ResetPrefixForIpv4(t *testing.T) {
-	var subnetArg string
-	rateLimitStoreMock.ResetFunc = func(subnet string) {
-		subnetArg = subnet
+
+func TestParseSubnetSizeToMask(t *testing.T) {
+	for _, tc := range []struct {
+		size, bits int
+		ok         bool
+	}{{24, 32, true}, {0, 32, true}, {33, 32, false}, {-1, 32, false}, {64, 128, true}, {129, 128, false}} {
+		_, err := parseSubnetSizeToMask(tc.size, tc.bits)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseSubnetSizeToMask(%d, %d) error = %v", tc.size, tc.bits, err)
+		}
 	}
+}
 
-	t.Run("ok", func(t *testing.T) {
-		subnetArg = ""
-		service = NewServiceImpl(configs.Config{PrefixSize: 24}, rateLimitStoreMock)
+func TestRateLimitCheckerImpl_ResetPrefixes(t *testing.T) {
+	var subnetArgs []string
+	rateLimitStoreMock.ResetFunc = func(subnet string) (bool, error) {
+		subnetArgs = append(subnetArgs, subnet)
+		return subnet != "10.0.9.0", nil
+	}
+	rateLimitStoreMock.SubnetsFunc = func() ([]store.SubnetState, error) {
+		return []store.SubnetState{{Subnet: "10.0.1.0"}, {Subnet: "10.1.0.0"}, {Subnet: "10.0.2.0"}, {Subnet: "2001:db8::"}}, nil
+	}
+	service = NewServiceImpl(configs.Config{PrefixSize: 24, PrefixSizeV6: 64}, rateLimitStoreMock, clock.New())
+
+	for _, tc := range []struct {
+		name       string
+		targets    []string
+		subnetArgs []string
+		reset      []string
+	}{
+		{"ip", []string{"123.123.123.123"}, []string{"123.123.123.0"}, []string{"123.123.123.0"}},
+		{"ipv6", []string{"2001:db8::1"}, []string{"2001:db8::"}, []string{"2001:db8::"}},
+		{"narrow cidr", []string{"123.123.123.128/25"}, []string{"123.123.123.0"}, []string{"123.123.123.0"}},
+		{"wide cidr", []string{"10.0.0.0/16"}, []string{"10.0.1.0", "10.0.2.0"}, []string{"10.0.1.0", "10.0.2.0"}},
+		{"wide ipv6 cidr", []string{"2001:db8::/32"}, []string{"2001:db8::"}, []string{"2001:db8::"}},
+		{"bulk", []string{"10.0.1.7", "10.0.0.0/16", "10.0.9.1"}, []string{"10.0.1.0", "10.0.2.0", "10.0.9.0"}, []string{"10.0.1.0", "10.0.2.0"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			subnetArgs = nil
+			reset, err := service.ResetPrefixes(tc.targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(subnetArgs, tc.subnetArgs) {
+				t.Errorf("expected subnets %v reset in store, actual %v", tc.subnetArgs, subnetArgs)
+			}
+			if !reflect.DeepEqual(reset, tc.reset) {
+				t.Errorf("expected tracked subnets %v reported, actual %v", tc.reset, reset)
+			}
+		})
+	}
 
-		err := service.ResetPrefixForIpv4(net.ParseIP("123.123.123.123"))
-		if err != nil {
-			t.Errorf("expected no error")
+	t.Run("invalid target", func(t *testing.T) {
+		subnetArgs = nil
+		_, err := service.ResetPrefixes([]string{"10.0.1.0", "444.444.444.444"})
+		if !errors.Is(err, ErrInvalidTarget) {
+			t.Errorf("expected ErrInvalidTarget, actual %v", err)
 		}
-		if subnetArg != "123.123.123.0" {
-			t.Errorf("expected subnet %s != actual %s", "123.123.123.0", subnetArg)
+		if len(subnetArgs) != 0 {
+			t.Errorf("expected nothing reset, actual %v", subnetArgs)
 		}
 	})
+}
 
-	t.Run("invalid arg", func(t *testing.T) {
-		service = NewServiceImpl(configs.Config{PrefixSize: 24}, rateLimitStoreMock)
-		err := service.ResetPrefixForIpv4(net.ParseIP("444.444.444.444"))
-		if err == nil {
-			t.Errorf("expected error for invalid ip addr")
-		}
-	})
+func TestRateLimitCheckerImpl_IsLimitExceededForIp_BlockedQuota(t *testing.T) {
+	rateLimitStoreMock.TakeFunc = func(subnet string) (store.Decision, error) {
+		return store.Decision{Allowed: false, Limit: 10, Remaining: 3}, nil
+	}
+	now := time.Unix(1000, 0)
+	service = NewServiceImpl(configs.Config{PrefixSize: 24, BlockingTimeout: time.Minute}, rateLimitStoreMock, clock.NewFake(now))
 
+	isBlocked, quota, err := service.IsLimitExceededForIp(net.ParseIP("123.123.123.123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBlocked {
+		t.Errorf("expected blocked")
+	}
+	if quota.Remaining != 0 {
+		t.Errorf("expected no remaining requests for blocked subnet, actual %d", quota.Remaining)
+	}
+	if !quota.BlockedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected blocking timeout when store does not know the blocking time, actual %s", quota.BlockedUntil)
+	}
+
+	rateLimitStoreMock.TakeFunc = func(subnet string) (store.Decision, error) {
+		return store.Decision{Allowed: false, Limit: 10, RetryAfter: 10 * time.Second}, nil
+	}
+	_, quota, _ = service.IsLimitExceededForIp(net.ParseIP("123.123.123.123"))
+	if !quota.BlockedUntil.Equal(now.Add(10 * time.Second)) {
+		t.Errorf("expected blocked for retry after of the store, actual %s", quota.BlockedUntil)
+	}
+}
+
+func TestRateLimitCheckerImpl_AccessList(t *testing.T) {
+	listFile := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(listFile, []byte("# known bad ranges\n203.0.113.0/24\n\n2001:db8:bad::/48 # scanners\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	denyList, err := configs.ReadList(listFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service = NewServiceImpl(configs.Config{
+		PrefixSize:   24,
+		PrefixSizeV6: 64,
+		AllowList:    []string{"10.0.0.0/8", "203.0.113.7", "2001:db8:bad:1::/64"},
+		DenyList:     append(denyList, "10.66.0.0/16"),
+	}, rateLimitStoreMock, clock.New())
+
+	taken := 0
+	rateLimitStoreMock.TakeFunc = func(subnet string) (store.Decision, error) {
+		taken++
+		return store.Decision{Allowed: true, Limit: 10, Remaining: 9}, nil
+	}
+
+	for _, tc := range []struct {
+		ip      string
+		access  access
+		counted bool
+	}{
+		{ip: "10.1.2.3", access: accessAllow},
+		{ip: "203.0.113.1", access: accessDeny},
+		{ip: "10.66.1.1", access: accessDeny},
+		{ip: "203.0.113.7", access: accessAllow},
+		{ip: "::ffff:203.0.113.1", access: accessDeny},
+		{ip: "2001:db8:bad::1", access: accessDeny},
+		{ip: "2001:db8:bad:1::1", access: accessAllow},
+		{ip: "111.111.111.111", access: accessNone, counted: true},
+		{ip: "2001:db8::1", access: accessNone, counted: true},
+	} {
+		t.Run(tc.ip, func(t *testing.T) {
+			taken = 0
+			isBlocked, quota, err := service.IsLimitExceededForIp(net.ParseIP(tc.ip))
+			switch tc.access {
+			case accessDeny:
+				if !errors.Is(err, ErrDenied) {
+					t.Errorf("expected ErrDenied, actual %v", err)
+				}
+			case accessAllow:
+				if err != nil || isBlocked || quota.Limit != 0 {
+					t.Errorf("expected allowed without limit, actual %t %+v %v", isBlocked, quota, err)
+				}
+			default:
+				if err != nil || isBlocked || quota.Limit != 10 {
+					t.Errorf("expected quota from store, actual %t %+v %v", isBlocked, quota, err)
+				}
+			}
+			if counted := taken == 1; counted != tc.counted {
+				t.Errorf("expected request counted by store %t, actual %t", tc.counted, counted)
+			}
+		})
+	}
+}
+
+func TestRateLimitCheckerImpl_RuntimeAccessList(t *testing.T) {
+	accessStore := store.NewInMemoryAccessListStore(clock.New())
+	service = NewServiceWithAccessList(configs.Config{
+		PrefixSize: 24,
+		DenyList:   []string{"203.0.113.0/24"},
+	}, rateLimitStoreMock, accessStore, clock.New())
+	rateLimitStoreMock.TakeFunc = func(subnet string) (store.Decision, error) {
+		return store.Decision{Allowed: true, Limit: 10, Remaining: 9}, nil
+	}
+
+	ip := net.ParseIP("198.51.100.1")
+	accessStore.Add(store.AccessEntry{List: store.AccessDeny, CIDR: "198.51.100.0/24"})
+	if _, _, err := service.IsLimitExceededForIp(ip); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected runtime deny entry applied immediately, actual %v", err)
+	}
+	accessStore.Remove(store.AccessDeny, "198.51.100.0/24")
+	if _, quota, err := service.IsLimitExceededForIp(ip); err != nil || quota.Limit != 10 {
+		t.Errorf("expected removed entry not applied, actual %+v %v", quota, err)
+	}
+
+	accessStore.Add(store.AccessEntry{List: store.AccessAllow, CIDR: "203.0.113.8/29", Reason: "partner"})
+	if _, quota, err := service.IsLimitExceededForIp(net.ParseIP("203.0.113.9")); err != nil || quota.Limit != 0 {
+		t.Errorf("expected runtime allow entry within static deny list, actual %+v %v", quota, err)
+	}
+	if _, _, err := service.IsLimitExceededForIp(net.ParseIP("203.0.113.1")); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected rest of static deny list denied, actual %v", err)
+	}
+}
+
+func TestRateLimitCheckerImpl_NilAccessList(t *testing.T) {
+	service = NewServiceWithAccessList(configs.Config{
+		PrefixSize: 24,
+		DenyList:   []string{"203.0.113.0/24"},
+	}, rateLimitStoreMock, nil, clock.New())
+	rateLimitStoreMock.TakeFunc = func(subnet string) (store.Decision, error) {
+		return store.Decision{Allowed: true, Limit: 10, Remaining: 9}, nil
+	}
+
+	if _, quota, err := service.IsLimitExceededForIp(net.ParseIP("198.51.100.1")); err != nil || quota.Limit != 10 {
+		t.Errorf("expected nil access list treated as empty, actual %+v %v", quota, err)
+	}
+	if _, _, err := service.IsLimitExceededForIp(net.ParseIP("203.0.113.1")); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected static deny list applied, actual %v", err)
+	}
+	if service.AccessList != nil {
+		t.Errorf("expected no access list to manage, actual %v", service.AccessList)
+	}
 }
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// access lists
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// AccessEntry is a network of the allow or deny list managed at runtime.
+type AccessEntry struct {
+	List string `json:"list"`
+	CIDR string `json:"cidr"`
+	// Reason is a free text note on why the network is listed.
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is the time the entry is removed at, zero if it never expires.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Network parses the CIDR of the entry, a single address is treated as a network of itself.
+func (e AccessEntry) Network() (*net.IPNet, error) {
+	networks, err := configs.ParseCIDRs([]string{e.CIDR})
+	if err != nil {
+		return nil, err
+	}
+	return networks[0], nil
+}
+
+func (e AccessEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// AccessListStore keeps the entries of the allow and deny lists added at runtime, expired entries are ignored.
+type AccessListStore interface {
+	// Add adds the entry to its list, the entry of the same network in the list is replaced.
+	// The CIDR is normalized, e.g. 10.1.2.3/8 is stored as 10.0.0.0/8.
+	Add(entry AccessEntry) (AccessEntry, error)
+	// Remove removes the network from the list and reports whether it was listed.
+	Remove(list string, cidr string) (bool, error)
+	// List returns the entries of both lists ordered by list and CIDR.
+	List() ([]AccessEntry, error)
+	// Lookup returns the entries of the networks containing the ip.
+	Lookup(ip net.IP) ([]AccessEntry, error)
+}
+
+type accessKey struct {
+	list string
+	cidr string
+}
+
+type accessItem struct {
+	entry   AccessEntry
+	network *net.IPNet
+}
+
+// InMemoryAccessListStore keeps the entries in memory, they are lost on restart.
+// Lookup scans all the entries, runtime lists are expected to stay small.
+type InMemoryAccessListStore struct {
+	mu      sync.RWMutex
+	entries map[accessKey]accessItem
+	clock   clock.Clock
+}
+
+func NewInMemoryAccessListStore(clk clock.Clock) *InMemoryAccessListStore {
+	return &InMemoryAccessListStore{entries: make(map[accessKey]accessItem), clock: clk}
+}
+
+func (a *InMemoryAccessListStore) Add(entry AccessEntry) (AccessEntry, error) {
+	if entry.List != AccessAllow && entry.List != AccessDeny {
+		return AccessEntry{}, fmt.Errorf("unknown access list %q", entry.List)
+	}
+	network, err := entry.Network()
+	if err != nil {
+		return AccessEntry{}, err
+	}
+	entry.CIDR = network.String()
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = a.clock.Now()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries[accessKey{list: entry.List, cidr: entry.CIDR}] = accessItem{entry: entry, network: network}
+	return entry, nil
+}
+
+func (a *InMemoryAccessListStore) Remove(list string, cidr string) (bool, error) {
+	network, err := AccessEntry{CIDR: cidr}.Network()
+	if err != nil {
+		return false, err
+	}
+	key := accessKey{list: list, cidr: network.String()}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	item, ok := a.entries[key]
+	delete(a.entries, key)
+	return ok && !item.entry.expired(a.clock.Now()), nil
+}
+
+func (a *InMemoryAccessListStore) List() ([]AccessEntry, error) {
+	now := a.clock.Now()
+	a.mu.Lock()
+	res := make([]AccessEntry, 0, len(a.entries))
+	for key, item := range a.entries {
+		if item.entry.expired(now) {
+			delete(a.entries, key)
+			continue
+		}
+		res = append(res, item.entry)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].List != res[j].List {
+			return res[i].List < res[j].List
+		}
+		return res[i].CIDR < res[j].CIDR
+	})
+	return res, nil
+}
+
+func (a *InMemoryAccessListStore) Lookup(ip net.IP) ([]AccessEntry, error) {
+	now := a.clock.Now()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var res []AccessEntry
+	for _, item := range a.entries {
+		if !item.entry.expired(now) && item.network.Contains(ip) {
+			res = append(res, item.entry)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInMemoryAccessListStore(t *testing.T) {
+	t.Run("add, lookup and remove", func(t *testing.T) {
+		accessStore := NewInMemoryAccessListStore(clock.NewFake(testStart))
+		entry, err := accessStore.Add(AccessEntry{List: AccessDeny, CIDR: "203.0.113.7/24", Reason: "scanner"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.CIDR != "203.0.113.0/24" || !entry.CreatedAt.Equal(testStart) {
+			t.Errorf("expected normalized cidr and creation time, actual %+v", entry)
+		}
+		if _, err := accessStore.Add(AccessEntry{List: AccessAllow, CIDR: "2001:db8::1"}); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, _ := accessStore.Lookup(net.ParseIP("203.0.113.1"))
+		if len(entries) != 1 || entries[0].Reason != "scanner" {
+			t.Errorf("expected deny entry found, actual %+v", entries)
+		}
+		if entries, _ := accessStore.Lookup(net.ParseIP("2001:db8::2")); len(entries) != 0 {
+			t.Errorf("expected single address entry not matching other addresses, actual %+v", entries)
+		}
+
+		removed, err := accessStore.Remove(AccessDeny, "203.0.113.0/24")
+		if err != nil || !removed {
+			t.Errorf("expected entry removed, actual %t %v", removed, err)
+		}
+		if removed, _ := accessStore.Remove(AccessDeny, "203.0.113.0/24"); removed {
+			t.Errorf("expected missing entry not removed")
+		}
+		if entries, _ := accessStore.Lookup(net.ParseIP("203.0.113.1")); len(entries) != 0 {
+			t.Errorf("expected removed entry not found, actual %+v", entries)
+		}
+	})
+
+	t.Run("replace and list", func(t *testing.T) {
+		accessStore := NewInMemoryAccessListStore(clock.NewFake(testStart))
+		accessStore.Add(AccessEntry{List: AccessDeny, CIDR: "10.0.0.0/8", Reason: "first"})
+		accessStore.Add(AccessEntry{List: AccessDeny, CIDR: "10.0.0.0/8", Reason: "second"})
+		accessStore.Add(AccessEntry{List: AccessAllow, CIDR: "10.1.0.0/16"})
+
+		entries, _ := accessStore.List()
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 entries, actual %+v", entries)
+		}
+		if entries[0].List != AccessAllow || entries[1].Reason != "second" {
+			t.Errorf("expected entries ordered by list with replaced reason, actual %+v", entries)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		clk := clock.NewFake(testStart)
+		accessStore := NewInMemoryAccessListStore(clk)
+		accessStore.Add(AccessEntry{List: AccessDeny, CIDR: "10.0.0.0/8", ExpiresAt: testStart.Add(time.Hour)})
+
+		clk.Advance(time.Hour - time.Millisecond)
+		if entries, _ := accessStore.Lookup(net.ParseIP("10.0.0.1")); len(entries) != 1 {
+			t.Errorf("expected entry active before expiry, actual %+v", entries)
+		}
+		clk.Advance(time.Millisecond)
+		if entries, _ := accessStore.Lookup(net.ParseIP("10.0.0.1")); len(entries) != 0 {
+			t.Errorf("expected expired entry ignored, actual %+v", entries)
+		}
+		if entries, _ := accessStore.List(); len(entries) != 0 {
+			t.Errorf("expected expired entry not listed, actual %+v", entries)
+		}
+	})
+
+	t.Run("invalid entries", func(t *testing.T) {
+		accessStore := NewInMemoryAccessListStore(clock.NewFake(testStart))
+		if _, err := accessStore.Add(AccessEntry{List: "block", CIDR: "10.0.0.0/8"}); err == nil {
+			t.Errorf("expected error for unknown list")
+		}
+		if _, err := accessStore.Add(AccessEntry{List: AccessDeny, CIDR: "10.0.0.0/33"}); err == nil {
+			t.Errorf("expected error for invalid cidr")
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Compare the algorithms with:
+//
+//	go test ./pkg/store -run '^$' -bench . -benchmem
+
+var benchConfig = configs.Config{
+	RequestLimit:    100,
+	TimeInterval:    time.Minute,
+	BlockingTimeout: time.Minute,
+}
+
+var benchStores = map[string]func(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore{
+	configs.AlgorithmFixedWindow:   NewInMemoryStoreRateLimitStore,
+	configs.AlgorithmTokenBucket:   NewTokenBucketRateLimitStore,
+	configs.AlgorithmSlidingLog:    NewSlidingLogRateLimitStore,
+	configs.AlgorithmSlidingWindow: NewSlidingWindowRateLimitStore,
+	configs.AlgorithmGCRA:          NewGCRARateLimitStore,
+}
+
+func benchSubnets(n int) []string {
+	subnets := make([]string, n)
+	for i := range subnets {
+		subnets[i] = fmt.Sprintf("10.%d.%d.0/24", i/256%256, i%256)
+	}
+	return subnets
+}
+
+// discardLogs silences logging of blocked and evicted subnets
+func discardLogs(tb testing.TB) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+}
+
+// BenchmarkCheck measures the cost of an allowed check spread over 1000 subnets.
+func BenchmarkCheck(b *testing.B) {
+	discardLogs(b)
+	subnets := benchSubnets(1000)
+	for name, newStore := range benchStores {
+		b.Run(name, func(b *testing.B) {
+			conf := benchConfig
+			conf.RequestLimit = b.N
+			rateLimitStore := newStore(conf, clock.New())
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rateLimitStore.Take(subnets[i%len(subnets)])
+			}
+		})
+	}
+}
+
+// BenchmarkCheckParallel measures throughput and latency percentiles of allowed checks
+// made by 64 goroutines per CPU over 10000 subnets.
+func BenchmarkCheckParallel(b *testing.B) {
+	discardLogs(b)
+	subnets := benchSubnets(10000)
+	for name, newStore := range benchStores {
+		b.Run(name, func(b *testing.B) {
+			conf := benchConfig
+			conf.RequestLimit = b.N
+			rateLimitStore := newStore(conf, clock.New())
+
+			var mu sync.Mutex
+			var latencies []time.Duration
+			var next uint32
+			b.SetParallelism(64)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint32(&next, 7919))
+				var local []time.Duration
+				for pb.Next() {
+					start := time.Now()
+					rateLimitStore.Take(subnets[i%len(subnets)])
+					local = append(local, time.Since(start))
+					i++
+				}
+				mu.Lock()
+				latencies = append(latencies, local...)
+				mu.Unlock()
+			})
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool {
+				return latencies[i] < latencies[j]
+			})
+			for _, p := range []float64{50, 99, 99.9} {
+				b.ReportMetric(float64(latencies[int(float64(len(latencies)-1)*p/100)].Nanoseconds()), fmt.Sprintf("p%g-ns", p))
+			}
+		})
+	}
+}
+
+// BenchmarkMemoryPerSubnet reports heap bytes kept per subnet having used its whole quota.
+func BenchmarkMemoryPerSubnet(b *testing.B) {
+	const subnetsCount = 1000
+	discardLogs(b)
+	subnets := benchSubnets(subnetsCount)
+	for name, newStore := range benchStores {
+		b.Run(name, func(b *testing.B) {
+			var bytesPerSubnet float64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				rateLimitStore := newStore(benchConfig, clock.New())
+				for _, s := range subnets {
+					for j := 0; j < benchConfig.RequestLimit; j++ {
+						rateLimitStore.Take(s)
+					}
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				bytesPerSubnet = float64(after.HeapAlloc-before.HeapAlloc) / subnetsCount
+				runtime.KeepAlive(rateLimitStore)
+			}
+			b.ReportMetric(bytesPerSubnet, "B/subnet")
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+var (
+	boltSubnetsBucket = []byte("subnets")
+	boltMetaBucket    = []byte("meta")
+	boltAlgorithmKey  = []byte("algorithm")
+)
+
+// boltCompactBatch is the number of subnets checked by one compaction transaction,
+// so that compaction does not hold the database lock for long
+const boltCompactBatch = 1000
+
+type boltRecord struct {
+	LastSeen time.Time    `json:"last_seen"`
+	State    limiterState `json:"state"`
+}
+
+// BoltRateLimitStore keeps the subnetLimiter state of every subnet in an embedded bbolt database file,
+// so that limits survive restarts of single node deployments without redis. Every request is a write transaction,
+// so that take is atomic and durable.
+//
+// Subnets idle longer than the idle timeout are treated as new on read and deleted by the compaction
+// running every idle timeout, the space they took is reused by the database.
+type BoltRateLimitStore struct {
+	limiterFactory
+	db             *bolt.DB
+	timeout        time.Duration
+	idle           time.Duration
+	clock          clock.Clock
+	stopCompaction func()
+}
+
+// NewBoltRateLimitStore opens the database at conf.BoltPath with the limiters of conf.Algorithm.
+// The state saved by another algorithm is dropped.
+func NewBoltRateLimitStore(conf configs.Config, clk clock.Clock) (*BoltRateLimitStore, error) {
+	factory, err := limitersOf(conf)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(conf.BoltPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt database %s: %w", conf.BoltPath, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if algorithm := meta.Get(boltAlgorithmKey); algorithm != nil && string(algorithm) != factory.algorithm {
+			log.Printf("dropping subnets of algorithm %q from bolt database %s", algorithm, conf.BoltPath)
+			if err := tx.DeleteBucket(boltSubnetsBucket); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltSubnetsBucket); err != nil {
+			return err
+		}
+		return meta.Put(boltAlgorithmKey, []byte(factory.algorithm))
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init bolt database %s: %w", conf.BoltPath, err)
+	}
+
+	b := &BoltRateLimitStore{
+		limiterFactory: factory,
+		db:             db,
+		timeout:        conf.BlockingTimeout,
+		idle:           factory.idleTimeout(conf),
+		clock:          clk,
+	}
+	b.stopCompaction = repeat(clk, b.idle, func() {
+		if err := b.compact(); err != nil {
+			log.Printf("compacting bolt database %s: %v", conf.BoltPath, err)
+		}
+	})
+	return b, nil
+}
+
+func (b *BoltRateLimitStore) Take(subnet string) (Decision, error) {
+	var decision Decision
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltSubnetsBucket)
+		now := b.clock.Now()
+		limiter, err := b.limiterOf(bucket, subnet, now)
+		if err != nil {
+			return err
+		}
+		decision = take(limiter, subnet, now, b.timeout)
+		value, err := json.Marshal(boltRecord{LastSeen: now, State: limiter.state()})
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(subnet), value)
+	})
+	if err != nil {
+		return Decision{}, fmt.Errorf("bolt take for subnet %s: %w", subnet, err)
+	}
+	return decision, nil
+}
+
+// Status returns the quota of the subnet without counting a request.
+func (b *BoltRateLimitStore) Status(subnet string) (Quota, error) {
+	var quota Quota
+	err := b.db.View(func(tx *bolt.Tx) error {
+		now := b.clock.Now()
+		limiter, err := b.limiterOf(tx.Bucket(boltSubnetsBucket), subnet, now)
+		if err != nil {
+			return err
+		}
+		quota = status(limiter, now)
+		return nil
+	})
+	if err != nil {
+		return Quota{}, fmt.Errorf("bolt status for subnet %s: %w", subnet, err)
+	}
+	return quota, nil
+}
+
+func (b *BoltRateLimitStore) Reset(subnet string) (bool, error) {
+	log.Printf("resetting blocking and request counter for subnet %s", subnet)
+	var tracked bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltSubnetsBucket)
+		var record boltRecord
+		if value := bucket.Get([]byte(subnet)); value != nil && json.Unmarshal(value, &record) == nil {
+			tracked = b.clock.Now().Sub(record.LastSeen) <= b.idle
+		}
+		return bucket.Delete([]byte(subnet))
+	})
+	if err != nil {
+		return false, fmt.Errorf("bolt reset for subnet %s: %w", subnet, err)
+	}
+	return tracked, nil
+}
+
+func (b *BoltRateLimitStore) Subnets() ([]SubnetState, error) {
+	var res []SubnetState
+	err := b.db.View(func(tx *bolt.Tx) error {
+		now := b.clock.Now()
+		return tx.Bucket(boltSubnetsBucket).ForEach(func(k, v []byte) error {
+			var record boltRecord
+			if err := json.Unmarshal(v, &record); err != nil || now.Sub(record.LastSeen) > b.idle {
+				// left for compaction
+				return nil
+			}
+			limiter := b.newLimiter(now)
+			limiter.restore(record.State)
+			res = append(res, subnetState(string(k), limiter, now, b.timeout))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bolt subnets: %w", err)
+	}
+	return res, nil
+}
+
+func (b *BoltRateLimitStore) CloseStore() {
+	b.stopCompaction()
+	if err := b.db.Close(); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// limiterOf restores the limiter of the subnet, the subnet idle longer than the idle timeout gets a new one
+func (b *BoltRateLimitStore) limiterOf(bucket *bolt.Bucket, subnet string, now time.Time) (subnetLimiter, error) {
+	limiter := b.newLimiter(now)
+	value := bucket.Get([]byte(subnet))
+	if value == nil {
+		return limiter, nil
+	}
+	var record boltRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("decode record: %w", err)
+	}
+	if now.Sub(record.LastSeen) <= b.idle {
+		limiter.restore(record.State)
+	}
+	return limiter, nil
+}
+
+// compact deletes the subnets idle longer than the idle timeout and the records that can not be decoded,
+// checking boltCompactBatch subnets per transaction.
+func (b *BoltRateLimitStore) compact() error {
+	now := b.clock.Now()
+	var next []byte
+	for {
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(boltSubnetsBucket)
+			cursor := bucket.Cursor()
+			k, v := cursor.First()
+			if next != nil {
+				k, v = cursor.Seek(next)
+			}
+			var expired [][]byte
+			for n := 0; k != nil && n < boltCompactBatch; n++ {
+				var record boltRecord
+				if err := json.Unmarshal(v, &record); err != nil || now.Sub(record.LastSeen) > b.idle {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+				k, v = cursor.Next()
+			}
+			if k == nil {
+				next = nil
+			} else {
+				// the key is valid only during the transaction
+				next = append(next[:0], k...)
+			}
+			for _, key := range expired {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+			evictedSubnets.WithLabelValues(evictExpired).Add(float64(len(expired)))
+			return nil
+		})
+		if err != nil || next == nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func initBoltStore(t *testing.T, config configs.Config, clk clock.Clock) *BoltRateLimitStore {
+	if config.BoltPath == "" {
+		config.BoltPath = filepath.Join(t.TempDir(), "antibot.db")
+	}
+	boltStore, err := NewBoltRateLimitStore(config, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return boltStore
+}
+
+func takeBolt(t *testing.T, boltStore *BoltRateLimitStore) Decision {
+	decision, err := boltStore.Take(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decision
+}
+
+func (b *BoltRateLimitStore) stored() int {
+	n := 0
+	b.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltSubnetsBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+func TestBoltRateLimitStore(t *testing.T) {
+	conf := configs.Config{
+		RequestLimit:    1,
+		TimeInterval:    time.Second,
+		BlockingTimeout: 3 * time.Second,
+	}
+
+	t.Run("block ", func(t *testing.T) {
+		clk := clock.NewFake(testStart)
+		boltStore := initBoltStore(t, conf, clk)
+		defer boltStore.CloseStore()
+
+		if !takeBolt(t, boltStore).Allowed {
+			t.Errorf("expected first request allowed")
+		}
+		if takeBolt(t, boltStore).Allowed {
+			t.Errorf("expected request over the limit denied")
+		}
+		clk.Advance(3*time.Second - time.Millisecond)
+		if decision := takeBolt(t, boltStore); decision.Allowed || decision.RetryAfter != time.Millisecond {
+			t.Errorf("expected blocked until the blocking timeout, actual %+v", decision)
+		}
+		clk.Advance(time.Millisecond)
+		if !takeBolt(t, boltStore).Allowed {
+			t.Errorf("expected unblocked after the blocking timeout")
+		}
+	})
+
+	t.Run("reset ", func(t *testing.T) {
+		boltStore := initBoltStore(t, conf, clock.NewFake(testStart))
+		defer boltStore.CloseStore()
+
+		takeBolt(t, boltStore)
+		takeBolt(t, boltStore)
+		if _, err := boltStore.Reset(subnet); err != nil {
+			t.Fatal(err)
+		}
+		if !takeBolt(t, boltStore).Allowed {
+			t.Errorf("expected allowed after reset")
+		}
+	})
+
+	t.Run("status ", func(t *testing.T) {
+		boltStore := initBoltStore(t, conf, clock.NewFake(testStart))
+		defer boltStore.CloseStore()
+
+		takeBolt(t, boltStore)
+		takeBolt(t, boltStore)
+		quota, err := boltStore.Status(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quota.Remaining != 0 || !quota.BlockedUntil.Equal(testStart.Add(3*time.Second)) {
+			t.Errorf("expected blocked quota, actual %+v", quota)
+		}
+	})
+
+	t.Run("survives reopening ", func(t *testing.T) {
+		reopenConf := conf
+		reopenConf.BoltPath = filepath.Join(t.TempDir(), "antibot.db")
+		clk := clock.NewFake(testStart)
+		boltStore := initBoltStore(t, reopenConf, clk)
+		takeBolt(t, boltStore)
+		takeBolt(t, boltStore)
+		boltStore.CloseStore()
+
+		boltStore = initBoltStore(t, reopenConf, clk)
+		defer boltStore.CloseStore()
+		if takeBolt(t, boltStore).Allowed {
+			t.Errorf("expected subnet blocked after reopening")
+		}
+	})
+
+	t.Run("other algorithm dropped ", func(t *testing.T) {
+		reopenConf := conf
+		reopenConf.BoltPath = filepath.Join(t.TempDir(), "antibot.db")
+		clk := clock.NewFake(testStart)
+		boltStore := initBoltStore(t, reopenConf, clk)
+		takeBolt(t, boltStore)
+		boltStore.CloseStore()
+
+		reopenConf.Algorithm = configs.AlgorithmGCRA
+		boltStore = initBoltStore(t, reopenConf, clk)
+		defer boltStore.CloseStore()
+		if n := boltStore.stored(); n != 0 {
+			t.Errorf("expected subnets of another algorithm dropped, actual %d", n)
+		}
+	})
+
+	t.Run("expiry on read and compaction ", func(t *testing.T) {
+		clk := clock.NewFake(testStart)
+		boltStore := initBoltStore(t, conf, clk)
+		defer boltStore.CloseStore()
+
+		takeBolt(t, boltStore)
+		takeBolt(t, boltStore)
+		// the idle timeout is the blocking timeout plus the interval, compaction runs every idle timeout
+		clk.Advance(4*time.Second + time.Millisecond)
+		if boltStore.stored() != 1 {
+			t.Errorf("expected subnet kept until compaction")
+		}
+		quota, _ := boltStore.Status(subnet)
+		if quota.Remaining != 1 {
+			t.Errorf("expected idle subnet read as new, actual %+v", quota)
+		}
+
+		boltStore.Take("other")
+		clk.Advance(4 * time.Second)
+		if n := boltStore.stored(); n != 1 {
+			t.Errorf("expected idle subnet deleted by compaction, actual %d subnets", n)
+		}
+	})
+
+	t.Run("exact limit under concurrency ", func(t *testing.T) {
+		boltStore := initBoltStore(t, configs.Config{
+			RequestLimit:    50,
+			TimeInterval:    time.Minute,
+			BlockingTimeout: time.Minute,
+		}, clock.NewFake(testStart))
+		defer boltStore.CloseStore()
+
+		if allowed := takeConcurrently(boltStore, 100, 10); allowed != 50 {
+			t.Errorf("expected exactly 50 requests allowed, actual %d", allowed)
+		}
+	})
+}
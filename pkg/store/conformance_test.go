@@ -0,0 +1,66 @@
+package store_test
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store/storetest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var algorithms = []string{
+	configs.AlgorithmFixedWindow,
+	configs.AlgorithmTokenBucket,
+	configs.AlgorithmSlidingLog,
+	configs.AlgorithmSlidingWindow,
+	configs.AlgorithmGCRA,
+}
+
+func TestConformance(t *testing.T) {
+	testStart := time.Unix(1000, 0)
+
+	memoryStores := map[string]func(conf configs.Config, clk clock.Clock) *store.InMemoryStoreRateLimitStore{
+		configs.AlgorithmFixedWindow:   store.NewInMemoryStoreRateLimitStore,
+		configs.AlgorithmTokenBucket:   store.NewTokenBucketRateLimitStore,
+		configs.AlgorithmSlidingLog:    store.NewSlidingLogRateLimitStore,
+		configs.AlgorithmSlidingWindow: store.NewSlidingWindowRateLimitStore,
+		configs.AlgorithmGCRA:          store.NewGCRARateLimitStore,
+	}
+	for _, algorithm := range algorithms {
+		t.Run("memory/"+algorithm, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T, conf configs.Config) storetest.Subject {
+				clk := clock.NewFake(testStart)
+				return storetest.Subject{Store: memoryStores[algorithm](conf, clk), Advance: clk.Advance}
+			})
+		})
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run("bolt/"+algorithm, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T, conf configs.Config) storetest.Subject {
+				conf.Algorithm = algorithm
+				conf.BoltPath = filepath.Join(t.TempDir(), "antibot.db")
+				clk := clock.NewFake(testStart)
+				boltStore, err := store.NewBoltRateLimitStore(conf, clk)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(boltStore.CloseStore)
+				return storetest.Subject{Store: boltStore, Advance: clk.Advance}
+			})
+		})
+	}
+
+	t.Run("redis", func(t *testing.T) {
+		storetest.Run(t, func(t *testing.T, conf configs.Config) storetest.Subject {
+			mr := miniredis.RunT(t)
+			conf.RedisAddr = mr.Addr()
+			redisStore := store.NewRedisRateLimitStore(conf)
+			t.Cleanup(redisStore.CloseStore)
+			return storetest.Subject{Store: redisStore, Advance: mr.FastForward}
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"container/list"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+// reasons of dropping subnet state from memory
+const (
+	evictExpired  = "expired"
+	evictCapacity = "capacity"
+)
+
+var evictedSubnets = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "store_evicted_subnets_total",
+		Help: "Number of subnets dropped by the memory and bolt stores, expired after inactivity or evicted over capacity.",
+	},
+	[]string{"reason"},
+)
+
+type lruEntry struct {
+	subnet   string
+	lastSeen time.Time
+}
+
+// subnetLRU orders subnets by the time of the last request, the least recently seen subnet is evicted first.
+type subnetLRU struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newSubnetLRU() *subnetLRU {
+	return &subnetLRU{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (l *subnetLRU) touch(subnet string, now time.Time) {
+	if elem, ok := l.elems[subnet]; ok {
+		elem.Value.(*lruEntry).lastSeen = now
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.elems[subnet] = l.order.PushFront(&lruEntry{subnet: subnet, lastSeen: now})
+}
+
+func (l *subnetLRU) remove(subnet string) {
+	if elem, ok := l.elems[subnet]; ok {
+		l.order.Remove(elem)
+		delete(l.elems, subnet)
+	}
+}
+
+func (l *subnetLRU) lastSeen(subnet string) (time.Time, bool) {
+	if elem, ok := l.elems[subnet]; ok {
+		return elem.Value.(*lruEntry).lastSeen, true
+	}
+	return time.Time{}, false
+}
+
+// oldest returns the least recently seen subnet
+func (l *subnetLRU) oldest() (lruEntry, bool) {
+	elem := l.order.Back()
+	if elem == nil {
+		return lruEntry{}, false
+	}
+	return *elem.Value.(*lruEntry), true
+}
+
+func (l *subnetLRU) len() int {
+	return l.order.Len()
+}
+
+// entries returns the subnets from the least recently seen
+func (l *subnetLRU) entries() []lruEntry {
+	res := make([]lruEntry, 0, l.order.Len())
+	for elem := l.order.Back(); elem != nil; elem = elem.Prev() {
+		res = append(res, *elem.Value.(*lruEntry))
+	}
+	return res
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func (i *InMemoryStoreRateLimitStore) tracked() int {
+	n := 0
+	for _, s := range i.shards {
+		s.Lock()
+		n += len(s.limiters)
+		s.Unlock()
+	}
+	return n
+}
+
+func TestInMemoryStoreEviction(t *testing.T) {
+	conf := configs.Config{
+		RequestLimit:    2,
+		TimeInterval:    50 * time.Millisecond,
+		BlockingTimeout: 50 * time.Millisecond,
+		// a single shard, idle subnets are evicted from the shard of the request
+		MaxSubnets: minShardSubnets,
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		expired := testutil.ToFloat64(evictedSubnets.WithLabelValues(evictExpired))
+		clk := clock.NewFake(testStart)
+		inMemStore := NewGCRARateLimitStore(conf, clk)
+		inMemStore.Take("idle")
+		inMemStore.Take(subnet)
+		// kept for the blocking timeout and the time quota takes to restore
+		clk.Advance(100 * time.Millisecond)
+		inMemStore.Take(subnet)
+		if n := inMemStore.tracked(); n != 2 {
+			t.Errorf("expected subnets kept before blocking timeout and quota restore, actual %d", n)
+		}
+
+		clk.Advance(time.Millisecond)
+		inMemStore.Take(subnet)
+		if n := inMemStore.tracked(); n != 1 {
+			t.Errorf("expected idle subnet forgotten, actual %d subnets", n)
+		}
+		if d := testutil.ToFloat64(evictedSubnets.WithLabelValues(evictExpired)) - expired; d != 1 {
+			t.Errorf("expected 1 expired subnet counted, actual %v", d)
+		}
+	})
+
+	t.Run("idle not listed", func(t *testing.T) {
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(conf, clk)
+		inMemStore.Take(subnet)
+		clk.Advance(inMemStore.idle + time.Millisecond)
+		if subnets, _ := inMemStore.Subnets(); len(subnets) != 0 {
+			t.Errorf("expected idle subnet not listed before eviction, actual %+v", subnets)
+		}
+		if reset, _ := inMemStore.Reset(subnet); reset {
+			t.Errorf("expected idle subnet not reported as reset")
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		idleConf := conf
+		idleConf.IdleTimeout = time.Second
+		clk := clock.NewFake(testStart)
+		inMemStore := NewGCRARateLimitStore(idleConf, clk)
+		inMemStore.Take("idle")
+		clk.Advance(time.Second)
+		inMemStore.Take(subnet)
+		if n := inMemStore.tracked(); n != 2 {
+			t.Errorf("expected subnets kept for idle timeout, actual %d", n)
+		}
+		clk.Advance(time.Millisecond)
+		inMemStore.Take(subnet)
+		if n := inMemStore.tracked(); n != 1 {
+			t.Errorf("expected idle subnet forgotten after idle timeout, actual %d subnets", n)
+		}
+	})
+
+	t.Run("capacity", func(t *testing.T) {
+		evicted := testutil.ToFloat64(evictedSubnets.WithLabelValues(evictCapacity))
+		capacityConf := conf
+		capacityConf.MaxSubnets = 2
+		capacityConf.TimeInterval = time.Minute
+		inMemStore := NewTokenBucketRateLimitStore(capacityConf, clock.NewFake(testStart))
+		inMemStore.Take("first")
+		inMemStore.Take("second")
+		inMemStore.Take("first")
+		inMemStore.Take("third")
+		if n := inMemStore.tracked(); n != 2 {
+			t.Errorf("expected 2 subnets tracked, actual %d", n)
+		}
+		quota, _ := inMemStore.Status("first")
+		if quota.Remaining != 0 {
+			t.Errorf("expected recently seen subnet kept, actual %+v", quota)
+		}
+		quota, _ = inMemStore.Status("second")
+		if quota.Remaining != 2 {
+			t.Errorf("expected least recently seen subnet evicted, actual %+v", quota)
+		}
+		if d := testutil.ToFloat64(evictedSubnets.WithLabelValues(evictCapacity)) - evicted; d != 1 {
+			t.Errorf("expected 1 evicted subnet counted, actual %v", d)
+		}
+	})
+}
+
+// TestSoakRandomSubnets feeds the stores with random subnets and checks that memory stays bounded.
+func TestSoakRandomSubnets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test skipped in short mode")
+	}
+	const maxSubnets = 1000
+	conf := configs.Config{
+		RequestLimit:    10,
+		TimeInterval:    time.Minute,
+		BlockingTimeout: time.Minute,
+		MaxSubnets:      maxSubnets,
+	}
+	discardLogs(t)
+
+	stores := map[string]*InMemoryStoreRateLimitStore{
+		configs.AlgorithmFixedWindow:   NewInMemoryStoreRateLimitStore(conf, clock.New()),
+		configs.AlgorithmTokenBucket:   NewTokenBucketRateLimitStore(conf, clock.New()),
+		configs.AlgorithmSlidingLog:    NewSlidingLogRateLimitStore(conf, clock.New()),
+		configs.AlgorithmSlidingWindow: NewSlidingWindowRateLimitStore(conf, clock.New()),
+		configs.AlgorithmGCRA:          NewGCRARateLimitStore(conf, clock.New()),
+	}
+
+	for name, inMemStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			var heap [2]uint64
+			for round := range heap {
+				deadline := time.Now().Add(500 * time.Millisecond)
+				for time.Now().Before(deadline) {
+					for i := 0; i < 1000; i++ {
+						inMemStore.Take(fmt.Sprintf("%x:%x:%x:%x::/64", rand.Uint32()&0xffff, rand.Uint32()&0xffff, rand.Uint32()&0xffff, rand.Uint32()&0xffff))
+					}
+				}
+				if n := inMemStore.tracked(); n > maxSubnets {
+					t.Fatalf("expected at most %d subnets tracked, actual %d", maxSubnets, n)
+				}
+				var stats runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				heap[round] = stats.HeapAlloc
+			}
+			t.Logf("heap after first round %d KiB, after second %d KiB", heap[0]/1024, heap[1]/1024)
+			if heap[1] > 2*heap[0] {
+				t.Errorf("expected heap bounded, grown from %d to %d bytes", heap[0], heap[1])
+			}
+		})
+	}
+}
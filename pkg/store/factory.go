@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"log"
+)
+
+// NewRateLimitStore creates the store selected by conf.Store and returns it with a function releasing its resources.
+// If conf.SnapshotPath is set the memory store is restored from the snapshot and saves it until the function is called.
+func NewRateLimitStore(conf configs.Config) (RateLimitStore, func(), error) {
+	switch conf.Store {
+	case configs.StoreMemory, "":
+		memStore, err := newMemoryStore(conf, clock.New())
+		if err != nil {
+			return nil, nil, err
+		}
+		if conf.SnapshotPath == "" {
+			// the memory store holds no resources
+			return memStore, func() {}, nil
+		}
+		if err := memStore.LoadSnapshot(conf.SnapshotPath); err != nil {
+			// a broken snapshot must not prevent the start, the subnets are counted from scratch
+			log.Printf("restoring snapshot from %s: %v", conf.SnapshotPath, err)
+		}
+		return memStore, memStore.SaveSnapshotsEvery(conf.SnapshotPath, conf.SnapshotEvery), nil
+	case configs.StoreRedis:
+		if conf.Algorithm != configs.AlgorithmFixedWindow && conf.Algorithm != "" {
+			return nil, nil, fmt.Errorf("algorithm %q is not supported by redis store", conf.Algorithm)
+		}
+		redisStore := NewRedisRateLimitStore(conf)
+		if err := redisStore.client.Ping(context.Background()).Err(); err != nil {
+			redisStore.CloseStore()
+			return nil, nil, fmt.Errorf("connect to redis %s: %w", conf.RedisAddr, err)
+		}
+		return redisStore, redisStore.CloseStore, nil
+	case configs.StoreBolt:
+		boltStore, err := NewBoltRateLimitStore(conf, clock.New())
+		if err != nil {
+			return nil, nil, err
+		}
+		return boltStore, boltStore.CloseStore, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store type %q", conf.Store)
+	}
+}
+
+func newMemoryStore(conf configs.Config, clk clock.Clock) (*InMemoryStoreRateLimitStore, error) {
+	factory, err := limitersOf(conf)
+	if err != nil {
+		return nil, err
+	}
+	return newInMemoryStore(conf, clk, factory), nil
+}
+
+// limitersOf returns the limiters of the algorithm selected by conf.Algorithm
+func limitersOf(conf configs.Config) (limiterFactory, error) {
+	switch conf.Algorithm {
+	case configs.AlgorithmFixedWindow, "":
+		return fixedWindowLimiters(conf), nil
+	case configs.AlgorithmTokenBucket:
+		return tokenBucketLimiters(conf), nil
+	case configs.AlgorithmSlidingLog:
+		return slidingLogLimiters(conf), nil
+	case configs.AlgorithmSlidingWindow:
+		return slidingWindowLimiters(conf), nil
+	case configs.AlgorithmGCRA:
+		return gcraLimiters(conf), nil
+	default:
+		return limiterFactory{}, fmt.Errorf("unknown algorithm %q", conf.Algorithm)
+	}
+}
@@ -0,0 +1,57 @@
+package store
+
+import "time"
+
+// fixedWindow counts requests in windows of the interval starting with the first request of the subnet.
+type fixedWindow struct {
+	limit    int
+	interval time.Duration
+	count    int
+	resetAt  time.Time
+	blocked  time.Time
+}
+
+// advance starts a new window if the current one has ended
+func (w *fixedWindow) advance(now time.Time) {
+	if !now.Before(w.resetAt) {
+		w.count = 0
+		w.resetAt = now.Add(w.interval)
+	}
+}
+
+func (w *fixedWindow) allow(now time.Time) bool {
+	w.advance(now)
+	if w.count >= w.limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+func (w *fixedWindow) block(now time.Time, until time.Time) {
+	w.blocked = until
+}
+
+func (w *fixedWindow) blockedUntil(now time.Time) time.Time {
+	if now.Before(w.blocked) {
+		return w.blocked
+	}
+	return time.Time{}
+}
+
+func (w *fixedWindow) quota(now time.Time) Quota {
+	if !now.Before(w.resetAt) {
+		return newQuota(w.limit, 0, now.Add(w.interval), time.Time{})
+	}
+	return newQuota(w.limit, w.count, w.resetAt, time.Time{})
+}
+
+func (w *fixedWindow) state() limiterState {
+	return limiterState{Count: w.count, ResetAt: w.resetAt, BlockedUntil: w.blocked}
+}
+
+func (w *fixedWindow) restore(state limiterState) {
+	w.count = state.Count
+	w.resetAt = state.ResetAt
+	w.blocked = state.BlockedUntil
+}
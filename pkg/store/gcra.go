@@ -0,0 +1,116 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"time"
+)
+
+// gcraParams are shared by the limiters of all subnets.
+type gcraParams struct {
+	burst int
+	// emissionInterval is the time one request takes from the quota, TimeInterval / RequestLimit
+	emissionInterval time.Duration
+	// tolerance is how far the theoretical arrival time may run ahead of now, it allows bursts of burst requests
+	tolerance time.Duration
+}
+
+// gcra is the generic cell rate algorithm keeping only the theoretical arrival time (TAT) of the next request
+// per subnet. Every allowed request moves TAT by the emission interval, the request is allowed
+// if TAT does not run ahead of now by more than the tolerance. Allowance, remaining quota and reset time
+// are computed from TAT, so a subnet takes two timestamps of memory and needs no timers.
+//
+// Blocking is kept as its own timestamp, TAT can not tell blocking from an exhausted quota.
+// It also pushes TAT to the end of blocking plus the tolerance, so the unblocked subnet starts with a single request
+// and its quota refills at the steady rate like after exhausting the burst.
+type gcra struct {
+	params *gcraParams
+	// theoretical arrival time in unix nanoseconds
+	tat int64
+	// end of blocking in unix nanoseconds, 0 if the subnet was never blocked
+	blocked int64
+}
+
+// NewGCRARateLimitStore creates the store allowing bursts of conf.Burst requests,
+// conf.RequestLimit is used as the burst if it is not set.
+func NewGCRARateLimitStore(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore {
+	return newInMemoryStore(conf, clk, gcraLimiters(conf))
+}
+
+func gcraLimiters(conf configs.Config) limiterFactory {
+	burst := conf.RequestLimit
+	if conf.Burst > 0 {
+		burst = conf.Burst
+	}
+	emissionInterval := conf.TimeInterval / time.Duration(conf.RequestLimit)
+	params := &gcraParams{
+		burst:            burst,
+		emissionInterval: emissionInterval,
+		tolerance:        emissionInterval * time.Duration(burst-1),
+	}
+	return limiterFactory{
+		algorithm: configs.AlgorithmGCRA,
+		newLimiter: func(now time.Time) subnetLimiter {
+			return &gcra{params: params}
+		},
+		restAfter: params.tolerance + params.emissionInterval,
+	}
+}
+
+// ahead returns how far TAT runs ahead of now
+func (g *gcra) ahead(now time.Time) time.Duration {
+	if d := time.Duration(g.tat - now.UnixNano()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (g *gcra) allow(now time.Time) bool {
+	ahead := g.ahead(now)
+	if ahead > g.params.tolerance {
+		return false
+	}
+	g.tat = now.Add(ahead + g.params.emissionInterval).UnixNano()
+	return true
+}
+
+func (g *gcra) block(now time.Time, until time.Time) {
+	g.blocked = until.UnixNano()
+	g.tat = until.Add(g.params.tolerance).UnixNano()
+}
+
+func (g *gcra) blockedUntil(now time.Time) time.Time {
+	if now.UnixNano() < g.blocked {
+		return time.Unix(0, g.blocked)
+	}
+	return time.Time{}
+}
+
+func (g *gcra) quota(now time.Time) Quota {
+	ahead := g.ahead(now)
+	remaining := int((g.params.tolerance + g.params.emissionInterval - ahead) / g.params.emissionInterval)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Quota{
+		Limit:     g.params.burst,
+		Remaining: remaining,
+		ResetAt:   now.Add(ahead),
+	}
+}
+
+func (g *gcra) state() limiterState {
+	state := limiterState{TAT: g.tat}
+	if g.blocked != 0 {
+		state.BlockedUntil = time.Unix(0, g.blocked)
+	}
+	return state
+}
+
+func (g *gcra) restore(state limiterState) {
+	g.tat = state.TAT
+	g.blocked = 0
+	if !state.BlockedUntil.IsZero() {
+		g.blocked = state.BlockedUntil.UnixNano()
+	}
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"testing"
+	"time"
+)
+
+func newTestGCRA(conf configs.Config) *gcra {
+	return NewGCRARateLimitStore(conf, clock.New()).newLimiter(time.Time{}).(*gcra)
+}
+
+func TestGCRA(t *testing.T) {
+	conf := configs.Config{RequestLimit: 10, TimeInterval: time.Second}
+	start := time.Unix(1000, 0)
+
+	t.Run("burst then steady rate", func(t *testing.T) {
+		limiter := newTestGCRA(conf)
+		for i := 0; i < 10; i++ {
+			if !limiter.allow(start) {
+				t.Fatalf("expected request %d allowed", i+1)
+			}
+		}
+		if limiter.allow(start) {
+			t.Errorf("expected request over burst denied")
+		}
+		if limiter.allow(start.Add(99 * time.Millisecond)) {
+			t.Errorf("expected request denied before emission interval")
+		}
+		if !limiter.allow(start.Add(100 * time.Millisecond)) {
+			t.Errorf("expected request allowed after emission interval")
+		}
+	})
+
+	t.Run("custom burst", func(t *testing.T) {
+		burstConf := conf
+		burstConf.Burst = 3
+		limiter := newTestGCRA(burstConf)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if limiter.allow(start) {
+				allowed++
+			}
+		}
+		if allowed != 3 {
+			t.Errorf("expected 3 requests allowed by burst, actual %d", allowed)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		limiter := newTestGCRA(conf)
+		if quota := limiter.quota(start); quota.Limit != 10 || quota.Remaining != 10 || !quota.ResetAt.Equal(start) {
+			t.Errorf("expected full quota, actual %+v", quota)
+		}
+		for i := 0; i < 4; i++ {
+			limiter.allow(start)
+		}
+		quota := limiter.quota(start)
+		if quota.Remaining != 6 {
+			t.Errorf("expected 6 of 10 remaining, actual %+v", quota)
+		}
+		if d := quota.ResetAt.Sub(start); d != 400*time.Millisecond {
+			t.Errorf("expected full quota in 400ms, actual %s", d)
+		}
+		if quota = limiter.quota(start.Add(250 * time.Millisecond)); quota.Remaining != 8 {
+			t.Errorf("expected 8 of 10 remaining after 250ms, actual %+v", quota)
+		}
+	})
+
+	t.Run("blocking", func(t *testing.T) {
+		limiter := newTestGCRA(conf)
+		for i := 0; i < 10; i++ {
+			limiter.allow(start)
+		}
+		if !limiter.blockedUntil(start).IsZero() {
+			t.Errorf("expected exhausted quota not to be reported as blocking")
+		}
+		until := start.Add(5 * time.Second)
+		limiter.block(start, until)
+		if blockedUntil := limiter.blockedUntil(start.Add(time.Second)); !blockedUntil.Equal(until) {
+			t.Errorf("expected blocked until %s, actual %s", until, blockedUntil)
+		}
+		if !limiter.blockedUntil(until).IsZero() {
+			t.Errorf("expected unblocked at the end of blocking")
+		}
+		if !limiter.allow(until) || limiter.allow(until) {
+			t.Errorf("expected single request allowed at the end of blocking")
+		}
+		if !limiter.allow(until.Add(100 * time.Millisecond)) {
+			t.Errorf("expected quota refilled at steady rate after blocking")
+		}
+	})
+}
+
+func TestGCRARateLimitStore(t *testing.T) {
+	clk := clock.NewFake(testStart)
+	gcraStore := NewGCRARateLimitStore(configs.Config{
+		RequestLimit:    2,
+		TimeInterval:    200 * time.Millisecond,
+		BlockingTimeout: 300 * time.Millisecond,
+	}, clk)
+
+	for i := 0; i < 2; i++ {
+		if decision, _ := gcraStore.Take(subnet); !decision.Allowed {
+			t.Errorf("expected request %d allowed", i+1)
+		}
+	}
+	if decision, _ := gcraStore.Take(subnet); decision.Allowed {
+		t.Errorf("expected blocked after exceeding burst")
+	}
+	if decision, _ := gcraStore.Take("other"); !decision.Allowed {
+		t.Errorf("expected other subnet not to be blocked")
+	}
+	quota, _ := gcraStore.Status(subnet)
+	if quota.Remaining != 0 || quota.BlockedUntil.IsZero() {
+		t.Errorf("expected blocked quota, actual %+v", quota)
+	}
+
+	// requests within the last emission interval of blocking do not block again
+	clk.Advance(299 * time.Millisecond)
+	if decision, _ := gcraStore.Take(subnet); decision.Allowed || decision.RetryAfter != time.Millisecond {
+		t.Errorf("expected blocked for the rest of blocking timeout, actual %+v", decision)
+	}
+	clk.Advance(time.Millisecond)
+	if decision, _ := gcraStore.Take(subnet); !decision.Allowed {
+		t.Errorf("expected unblocked after blocking timeout")
+	}
+
+	gcraStore.Take(subnet)
+	gcraStore.Take(subnet)
+	gcraStore.Reset(subnet)
+	if decision, _ := gcraStore.Take(subnet); !decision.Allowed {
+		t.Errorf("expected unblocked after resetting")
+	}
+}
+
+func TestGCRAShortBlockingTimeout(t *testing.T) {
+	clk := clock.NewFake(testStart)
+	// blocking shorter than the emission interval of 100ms
+	gcraStore := NewGCRARateLimitStore(configs.Config{
+		RequestLimit:    10,
+		TimeInterval:    time.Second,
+		BlockingTimeout: 50 * time.Millisecond,
+	}, clk)
+	for i := 0; i < 10; i++ {
+		gcraStore.Take(subnet)
+	}
+
+	decision, _ := gcraStore.Take(subnet)
+	if decision.Allowed || decision.RetryAfter != 50*time.Millisecond {
+		t.Errorf("expected denied request retried after blocking timeout, actual %+v", decision)
+	}
+	if quota, _ := gcraStore.Status(subnet); !quota.BlockedUntil.Equal(testStart.Add(50 * time.Millisecond)) {
+		t.Errorf("expected short block reported, actual %+v", quota)
+	}
+	clk.Advance(50 * time.Millisecond)
+	if quota, _ := gcraStore.Status(subnet); !quota.BlockedUntil.IsZero() {
+		t.Errorf("expected unblocked after blocking timeout, actual %+v", quota)
+	}
+}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"strings"
+	"time"
+)
+
+const redisKeyPrefix = "antibot"
+
+// takeScript counts the request for a subnet and blocks the subnet once the limit is exceeded, in one atomic step.
+// KEYS[1] - request counter, KEYS[2] - block flag.
+// ARGV[1] - request limit, ARGV[2] - interval in ms, ARGV[3] - blocking timeout in ms.
+// Returns {allowed 1 or 0, request count, counter ttl in ms, blocking ttl in ms, blocked by this request 1 or 0}.
+var takeScript = redis.NewScript(`
+local blockTtl = redis.call('PTTL', KEYS[2])
+if blockTtl > 0 then
+	local count = tonumber(redis.call('GET', KEYS[1]) or 0)
+	return {0, count, redis.call('PTTL', KEYS[1]), blockTtl, 0}
+end
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if count > tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[2], 1, 'PX', ARGV[3])
+	return {0, count, redis.call('PTTL', KEYS[1]), tonumber(ARGV[3]), 1}
+end
+return {1, count, redis.call('PTTL', KEYS[1]), 0, 0}
+`)
+
+// RedisRateLimitStore keeps request counters and blocks in redis, so that limits are shared between service replicas.
+type RedisRateLimitStore struct {
+	client    *redis.Client
+	reqLimit  int
+	timeLimit time.Duration
+	timeout   time.Duration
+}
+
+func NewRedisRateLimitStore(conf configs.Config) *RedisRateLimitStore {
+	return &RedisRateLimitStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     conf.RedisAddr,
+			Password: conf.RedisPassword,
+			DB:       conf.RedisDB,
+		}),
+		reqLimit:  conf.RequestLimit,
+		timeLimit: conf.TimeInterval,
+		timeout:   conf.BlockingTimeout,
+	}
+}
+
+func (r *RedisRateLimitStore) Take(subnet string) (Decision, error) {
+	res, err := takeScript.Run(context.Background(), r.client,
+		[]string{counterKey(subnet), blockKey(subnet)},
+		r.reqLimit, r.timeLimit.Milliseconds(), r.timeout.Milliseconds(),
+	).Int64Slice()
+	if err != nil {
+		return Decision{}, fmt.Errorf("redis take for subnet %s: %w", subnet, err)
+	}
+	if len(res) != 5 {
+		return Decision{}, fmt.Errorf("redis take for subnet %s: unexpected result %v", subnet, res)
+	}
+	allowed, count, resetTtl, blockTtl := res[0] == 1, int(res[1]), time.Duration(res[2])*time.Millisecond, time.Duration(res[3])*time.Millisecond
+	if res[4] == 1 {
+		log.Printf("blocking for subnet %s", subnet)
+	}
+
+	now := time.Now()
+	resetAt := now.Add(r.timeLimit)
+	if resetTtl > 0 {
+		resetAt = now.Add(resetTtl)
+	}
+	var blockedUntil time.Time
+	if blockTtl > 0 {
+		blockedUntil = now.Add(blockTtl)
+	}
+	return newDecision(newQuota(r.reqLimit, count, resetAt, time.Time{}), now, allowed, blockedUntil), nil
+}
+
+// Status returns the quota of the subnet without counting a request.
+func (r *RedisRateLimitStore) Status(subnet string) (Quota, error) {
+	ctx := context.Background()
+	var countCmd *redis.StringCmd
+	var resetCmd, blockCmd *redis.DurationCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		countCmd = pipe.Get(ctx, counterKey(subnet))
+		resetCmd = pipe.PTTL(ctx, counterKey(subnet))
+		blockCmd = pipe.PTTL(ctx, blockKey(subnet))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return Quota{}, fmt.Errorf("redis status for subnet %s: %w", subnet, err)
+	}
+
+	count, err := countCmd.Int()
+	if err != nil && err != redis.Nil {
+		return Quota{}, fmt.Errorf("redis status for subnet %s: %w", subnet, err)
+	}
+	now := time.Now()
+	resetAt := now.Add(r.timeLimit)
+	if ttl := resetCmd.Val(); ttl > 0 {
+		resetAt = now.Add(ttl)
+	}
+	var blockedUntil time.Time
+	if ttl := blockCmd.Val(); ttl > 0 {
+		blockedUntil = now.Add(ttl)
+	}
+	return newQuota(r.reqLimit, count, resetAt, blockedUntil), nil
+}
+
+func (r *RedisRateLimitStore) Reset(subnet string) (bool, error) {
+	log.Printf("resetting blocking and request counter for subnet %s", subnet)
+	deleted, err := r.client.Del(context.Background(), counterKey(subnet), blockKey(subnet)).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis reset for subnet %s: %w", subnet, err)
+	}
+	return deleted > 0, nil
+}
+
+// Subnets scans the counter and block keys, the state of each subnet is read in a single pipeline.
+func (r *RedisRateLimitStore) Subnets() ([]SubnetState, error) {
+	ctx := context.Background()
+	var subnets []string
+	seen := make(map[string]bool)
+	for _, pattern := range []string{counterKey("*"), blockKey("*")} {
+		iter := r.client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			if subnet, ok := subnetOfKey(iter.Val()); ok && !seen[subnet] {
+				seen[subnet] = true
+				subnets = append(subnets, subnet)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, fmt.Errorf("redis subnets: %w", err)
+		}
+	}
+
+	countCmds := make([]*redis.StringCmd, len(subnets))
+	resetCmds := make([]*redis.DurationCmd, len(subnets))
+	blockCmds := make([]*redis.DurationCmd, len(subnets))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, subnet := range subnets {
+			countCmds[i] = pipe.Get(ctx, counterKey(subnet))
+			resetCmds[i] = pipe.PTTL(ctx, counterKey(subnet))
+			blockCmds[i] = pipe.PTTL(ctx, blockKey(subnet))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis subnets: %w", err)
+	}
+
+	now := time.Now()
+	res := make([]SubnetState, 0, len(subnets))
+	for i, subnet := range subnets {
+		count, _ := countCmds[i].Int()
+		state := SubnetState{Subnet: subnet, Count: count}
+		resetAt := now.Add(r.timeLimit)
+		if ttl := resetCmds[i].Val(); ttl > 0 {
+			resetAt = now.Add(ttl)
+		}
+		var blockedUntil time.Time
+		if ttl := blockCmds[i].Val(); ttl > 0 {
+			blockedUntil = now.Add(ttl)
+			state.BlockedAt = blockedUntil.Add(-r.timeout)
+		}
+		if count == 0 && blockedUntil.IsZero() {
+			// expired between the scan and the pipeline
+			continue
+		}
+		state.Quota = newQuota(r.reqLimit, count, resetAt, blockedUntil)
+		res = append(res, state)
+	}
+	return res, nil
+}
+
+func (r *RedisRateLimitStore) CloseStore() {
+	if err := r.client.Close(); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// keys of one subnet share a hash tag to stay in the same redis cluster slot
+func counterKey(subnet string) string {
+	return fmt.Sprintf("%s:{%s}:count", redisKeyPrefix, subnet)
+}
+
+func blockKey(subnet string) string {
+	return fmt.Sprintf("%s:{%s}:block", redisKeyPrefix, subnet)
+}
+
+// subnetOfKey extracts the subnet from the hash tag of the key
+func subnetOfKey(key string) (string, bool) {
+	start := strings.IndexByte(key, '{')
+	end := strings.LastIndexByte(key, '}')
+	if start < 0 || end <= start {
+		return "", false
+	}
+	return key[start+1 : end], true
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"bytes"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func initRedisStore(t *testing.T, config configs.Config) (*RedisRateLimitStore, *miniredis.Miniredis, func()) {
+	mr := miniredis.RunT(t)
+	config.RedisAddr = mr.Addr()
+	redisStore := NewRedisRateLimitStore(config)
+	return redisStore, mr, func() {
+		redisStore.CloseStore()
+	}
+}
+
+func takeRedis(t *testing.T, redisStore *RedisRateLimitStore) Decision {
+	decision, err := redisStore.Take(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decision
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+
+	t.Run("ok case ", func(t *testing.T) {
+		redisStore, mr, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    1,
+			TimeInterval:    time.Second,
+			BlockingTimeout: 3 * time.Second,
+		})
+		defer closeStore()
+
+		for i := 0; i < 3; i++ {
+			if !takeRedis(t, redisStore).Allowed {
+				t.Errorf("expected false for 1 req of 1 max per 1 second")
+			}
+			mr.FastForward(time.Second)
+		}
+	})
+
+	t.Run("logs block transitions only", func(t *testing.T) {
+		redisStore, _, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    1,
+			TimeInterval:    time.Second,
+			BlockingTimeout: 3 * time.Second,
+		})
+		defer closeStore()
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		for i := 0; i < 4; i++ {
+			takeRedis(t, redisStore)
+		}
+		if lines := strings.Split(strings.TrimSpace(logs.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], "blocking for subnet") {
+			t.Errorf("expected a single line logged on blocking, actual %q", logs.String())
+		}
+	})
+
+	t.Run("block ", func(t *testing.T) {
+		redisStore, _, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    1,
+			TimeInterval:    time.Second,
+			BlockingTimeout: 3 * time.Second,
+		})
+		defer closeStore()
+
+		if !takeRedis(t, redisStore).Allowed {
+			t.Errorf("expected false for 1 req of 1 max per 1 second")
+		}
+		if takeRedis(t, redisStore).Allowed {
+			t.Errorf("expected request over the limit denied")
+		}
+		if takeRedis(t, redisStore).Allowed {
+			t.Errorf("expected blocked after exceeding limit")
+		}
+	})
+
+	t.Run("unblock on blocking timeout ", func(t *testing.T) {
+		redisStore, mr, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    1,
+			TimeInterval:    time.Second,
+			BlockingTimeout: 3 * time.Second,
+		})
+		defer closeStore()
+
+		takeRedis(t, redisStore)
+		takeRedis(t, redisStore)
+
+		mr.FastForward(2 * time.Second)
+		if takeRedis(t, redisStore).Allowed {
+			t.Errorf("expected blocked")
+		}
+		mr.FastForward(time.Second)
+		if !takeRedis(t, redisStore).Allowed {
+			t.Errorf("expected unblocked after timeout")
+		}
+	})
+
+	t.Run("reset ", func(t *testing.T) {
+		redisStore, _, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    1,
+			TimeInterval:    time.Second,
+			BlockingTimeout: 5 * time.Second,
+		})
+		defer closeStore()
+
+		takeRedis(t, redisStore)
+		takeRedis(t, redisStore)
+		if takeRedis(t, redisStore).Allowed {
+			t.Errorf("expected blocked after spam requests")
+		}
+
+		if _, err := redisStore.Reset(subnet); err != nil {
+			t.Fatal(err)
+		}
+		if !takeRedis(t, redisStore).Allowed {
+			t.Errorf("expected unblocked after resetting")
+		}
+	})
+
+	t.Run("subnets are counted separately ", func(t *testing.T) {
+		redisStore, _, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    1,
+			TimeInterval:    time.Second,
+			BlockingTimeout: 5 * time.Second,
+		})
+		defer closeStore()
+
+		takeRedis(t, redisStore)
+		takeRedis(t, redisStore)
+		decision, err := redisStore.Take("other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decision.Allowed {
+			t.Errorf("expected other subnet not to be blocked")
+		}
+	})
+
+	t.Run("status ", func(t *testing.T) {
+		redisStore, mr, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    2,
+			TimeInterval:    3 * time.Second,
+			BlockingTimeout: 5 * time.Second,
+		})
+		defer closeStore()
+
+		quota, err := redisStore.Status(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quota.Limit != 2 || quota.Remaining != 2 || !quota.BlockedUntil.IsZero() {
+			t.Errorf("expected full quota for unknown subnet, actual %+v", quota)
+		}
+
+		takeRedis(t, redisStore)
+		mr.FastForward(time.Second)
+		quota, _ = redisStore.Status(subnet)
+		if quota.Remaining != 1 {
+			t.Errorf("expected 1 remaining request, actual %+v", quota)
+		}
+		if until := time.Until(quota.ResetAt); until <= time.Second || until > 2*time.Second {
+			t.Errorf("expected reset in 2 seconds, actual %s", until)
+		}
+
+		takeRedis(t, redisStore)
+		takeRedis(t, redisStore)
+		quota, _ = redisStore.Status(subnet)
+		if quota.Remaining != 0 {
+			t.Errorf("expected no remaining requests, actual %+v", quota)
+		}
+		if until := time.Until(quota.BlockedUntil); until <= 4*time.Second || until > 5*time.Second {
+			t.Errorf("expected blocked for blocking timeout, actual %s", until)
+		}
+	})
+
+	t.Run("decision ", func(t *testing.T) {
+		redisStore, mr, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    2,
+			TimeInterval:    3 * time.Second,
+			BlockingTimeout: 5 * time.Second,
+		})
+		defer closeStore()
+
+		decision := takeRedis(t, redisStore)
+		if !decision.Allowed || decision.Limit != 2 || decision.Remaining != 1 || decision.RetryAfter != 0 {
+			t.Errorf("expected allowed with 1 remaining request, actual %+v", decision)
+		}
+		if until := time.Until(decision.ResetAt); until <= 2*time.Second || until > 3*time.Second {
+			t.Errorf("expected reset in 3 seconds, actual %s", until)
+		}
+		takeRedis(t, redisStore)
+
+		decision = takeRedis(t, redisStore)
+		if decision.Allowed || decision.Remaining != 0 || decision.RetryAfter != 5*time.Second {
+			t.Errorf("expected denied for blocking timeout, actual %+v", decision)
+		}
+		mr.FastForward(2 * time.Second)
+		if decision = takeRedis(t, redisStore); decision.Allowed || decision.RetryAfter != 3*time.Second {
+			t.Errorf("expected denied for the rest of blocking, actual %+v", decision)
+		}
+	})
+
+	t.Run("exact limit under concurrency ", func(t *testing.T) {
+		redisStore, _, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    50,
+			TimeInterval:    time.Minute,
+			BlockingTimeout: time.Minute,
+		})
+		defer closeStore()
+
+		if allowed := takeConcurrently(redisStore, 100, 10); allowed != 50 {
+			t.Errorf("expected exactly 50 requests allowed, actual %d", allowed)
+		}
+	})
+
+	t.Run("redis unavailable ", func(t *testing.T) {
+		redisStore, mr, closeStore := initRedisStore(t, configs.Config{
+			RequestLimit:    1,
+			TimeInterval:    time.Second,
+			BlockingTimeout: 5 * time.Second,
+		})
+		defer closeStore()
+		mr.Close()
+
+		if _, err := redisStore.Take(subnet); err == nil {
+			t.Errorf("expected error when redis is unavailable")
+		}
+	})
+}
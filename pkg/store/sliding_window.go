@@ -0,0 +1,179 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"math"
+	"time"
+)
+
+// slidingWindowParams are shared by the limiters of all subnets.
+type slidingWindowParams struct {
+	limit    int
+	interval time.Duration
+}
+
+// slidingLog keeps timestamps of the requests made during the last interval, so the limit is exact
+// at the cost of memory proportional to the limit. Suits endpoints with low limits.
+type slidingLog struct {
+	params *slidingWindowParams
+	// request timestamps in unix nanoseconds, oldest first
+	log     []int64
+	blocked time.Time
+}
+
+// slidingWindowCounter approximates the number of requests during the last interval by the counts of the current and
+// the previous fixed windows, weighting the previous one by its overlap with the sliding window. Takes constant memory.
+type slidingWindowCounter struct {
+	params      *slidingWindowParams
+	windowStart time.Time
+	prevCount   int
+	currCount   int
+	blocked     time.Time
+}
+
+func NewSlidingLogRateLimitStore(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore {
+	return newInMemoryStore(conf, clk, slidingLogLimiters(conf))
+}
+
+func NewSlidingWindowRateLimitStore(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore {
+	return newInMemoryStore(conf, clk, slidingWindowLimiters(conf))
+}
+
+func slidingLogLimiters(conf configs.Config) limiterFactory {
+	params := &slidingWindowParams{limit: conf.RequestLimit, interval: conf.TimeInterval}
+	return limiterFactory{
+		algorithm: configs.AlgorithmSlidingLog,
+		newLimiter: func(now time.Time) subnetLimiter {
+			return &slidingLog{params: params}
+		},
+		restAfter: params.interval,
+	}
+}
+
+func slidingWindowLimiters(conf configs.Config) limiterFactory {
+	params := &slidingWindowParams{limit: conf.RequestLimit, interval: conf.TimeInterval}
+	return limiterFactory{
+		algorithm: configs.AlgorithmSlidingWindow,
+		newLimiter: func(now time.Time) subnetLimiter {
+			return &slidingWindowCounter{params: params, windowStart: now.Truncate(params.interval)}
+		},
+		restAfter: 2 * params.interval,
+	}
+}
+
+// expire drops the timestamps out of the window ending at now
+func (l *slidingLog) expire(now time.Time) {
+	windowStart := now.Add(-l.params.interval).UnixNano()
+	i := 0
+	for i < len(l.log) && l.log[i] <= windowStart {
+		i++
+	}
+	if i > 0 {
+		l.log = append(l.log[:0], l.log[i:]...)
+	}
+}
+
+func (l *slidingLog) allow(now time.Time) bool {
+	l.expire(now)
+	if len(l.log) >= l.params.limit {
+		return false
+	}
+	l.log = append(l.log, now.UnixNano())
+	return true
+}
+
+func (l *slidingLog) block(now time.Time, until time.Time) {
+	l.blocked = until
+}
+
+func (l *slidingLog) blockedUntil(now time.Time) time.Time {
+	if now.Before(l.blocked) {
+		return l.blocked
+	}
+	return time.Time{}
+}
+
+func (l *slidingLog) quota(now time.Time) Quota {
+	windowStart := now.Add(-l.params.interval).UnixNano()
+	count := 0
+	resetAt := now
+	for _, ts := range l.log {
+		if ts > windowStart {
+			if count == 0 {
+				// the oldest request in the window frees its slot first
+				resetAt = time.Unix(0, ts).Add(l.params.interval)
+			}
+			count++
+		}
+	}
+	return newQuota(l.params.limit, count, resetAt, time.Time{})
+}
+
+func (l *slidingLog) state() limiterState {
+	return limiterState{Log: append([]int64(nil), l.log...), BlockedUntil: l.blocked}
+}
+
+func (l *slidingLog) restore(state limiterState) {
+	l.log = append(l.log[:0], state.Log...)
+	l.blocked = state.BlockedUntil
+}
+
+// advance moves the windows to the one containing now
+func (c *slidingWindowCounter) advance(now time.Time) {
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < c.params.interval {
+		return
+	}
+	if elapsed < 2*c.params.interval {
+		c.prevCount = c.currCount
+	} else {
+		c.prevCount = 0
+	}
+	c.currCount = 0
+	c.windowStart = now.Truncate(c.params.interval)
+}
+
+// estimate returns the weighted number of requests during the interval ending at now
+func (c *slidingWindowCounter) estimate(now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(c.windowStart))/float64(c.params.interval)
+	return float64(c.prevCount)*overlap + float64(c.currCount)
+}
+
+func (c *slidingWindowCounter) allow(now time.Time) bool {
+	c.advance(now)
+	if c.estimate(now)+1 > float64(c.params.limit) {
+		return false
+	}
+	c.currCount++
+	return true
+}
+
+func (c *slidingWindowCounter) block(now time.Time, until time.Time) {
+	c.blocked = until
+}
+
+func (c *slidingWindowCounter) blockedUntil(now time.Time) time.Time {
+	if now.Before(c.blocked) {
+		return c.blocked
+	}
+	return time.Time{}
+}
+
+func (c *slidingWindowCounter) quota(now time.Time) Quota {
+	current := *c
+	current.advance(now)
+	count := int(math.Ceil(current.estimate(now)))
+	return newQuota(c.params.limit, count, current.windowStart.Add(c.params.interval), time.Time{})
+}
+
+func (c *slidingWindowCounter) state() limiterState {
+	return limiterState{WindowStart: c.windowStart, PrevCount: c.prevCount, Count: c.currCount, BlockedUntil: c.blocked}
+}
+
+func (c *slidingWindowCounter) restore(state limiterState) {
+	c.windowStart = state.WindowStart
+	c.prevCount = state.PrevCount
+	c.currCount = state.Count
+	c.blocked = state.BlockedUntil
+}
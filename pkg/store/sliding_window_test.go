@@ -0,0 +1,177 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"testing"
+	"time"
+)
+
+func TestSlidingLog(t *testing.T) {
+	conf := configs.Config{RequestLimit: 10, TimeInterval: time.Second}
+	start := time.Unix(1000, 0)
+
+	t.Run("exact limit over any interval", func(t *testing.T) {
+		limiter := NewSlidingLogRateLimitStore(conf, clock.New()).newLimiter(start)
+		for i := 0; i < 10; i++ {
+			if !limiter.allow(start.Add(time.Duration(i) * 50 * time.Millisecond)) {
+				t.Fatalf("expected request %d allowed", i+1)
+			}
+		}
+		if limiter.allow(start.Add(990 * time.Millisecond)) {
+			t.Errorf("expected request over limit denied")
+		}
+		if !limiter.allow(start.Add(time.Second + time.Millisecond)) {
+			t.Errorf("expected request allowed once the oldest one left the interval")
+		}
+		if limiter.allow(start.Add(time.Second + 2*time.Millisecond)) {
+			t.Errorf("expected request denied, only one slot freed")
+		}
+	})
+
+	t.Run("no burst of twice the limit around window boundary", func(t *testing.T) {
+		limiter := NewSlidingLogRateLimitStore(conf, clock.New()).newLimiter(start)
+		boundary := start.Add(time.Second)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if limiter.allow(boundary.Add(-10 * time.Millisecond)) {
+				allowed++
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if limiter.allow(boundary.Add(10 * time.Millisecond)) {
+				allowed++
+			}
+		}
+		if allowed != 10 {
+			t.Errorf("expected 10 requests allowed within 20ms, actual %d", allowed)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		limiter := NewSlidingLogRateLimitStore(conf, clock.New()).newLimiter(start)
+		limiter.allow(start)
+		limiter.allow(start.Add(300 * time.Millisecond))
+		quota := limiter.quota(start.Add(500 * time.Millisecond))
+		if quota.Limit != 10 || quota.Remaining != 8 {
+			t.Errorf("expected 8 of 10 remaining, actual %+v", quota)
+		}
+		if !quota.ResetAt.Equal(start.Add(time.Second)) {
+			t.Errorf("expected the oldest slot freed at %s, actual %s", start.Add(time.Second), quota.ResetAt)
+		}
+	})
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	conf := configs.Config{RequestLimit: 10, TimeInterval: time.Second}
+	start := time.Unix(1000, 0)
+
+	t.Run("limit within window", func(t *testing.T) {
+		limiter := NewSlidingWindowRateLimitStore(conf, clock.New()).newLimiter(start)
+		for i := 0; i < 10; i++ {
+			if !limiter.allow(start) {
+				t.Fatalf("expected request %d allowed", i+1)
+			}
+		}
+		if limiter.allow(start.Add(500 * time.Millisecond)) {
+			t.Errorf("expected request over limit denied")
+		}
+	})
+
+	t.Run("previous window is weighted by overlap", func(t *testing.T) {
+		limiter := NewSlidingWindowRateLimitStore(conf, clock.New()).newLimiter(start)
+		for i := 0; i < 10; i++ {
+			limiter.allow(start)
+		}
+		// 70% into the next window the previous one counts as 3 requests
+		now := start.Add(1700 * time.Millisecond)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if limiter.allow(now) {
+				allowed++
+			}
+		}
+		if allowed != 7 {
+			t.Errorf("expected 7 requests allowed, actual %d", allowed)
+		}
+	})
+
+	t.Run("no burst of twice the limit around window boundary", func(t *testing.T) {
+		limiter := NewSlidingWindowRateLimitStore(conf, clock.New()).newLimiter(start)
+		boundary := start.Add(time.Second)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if limiter.allow(boundary.Add(-10 * time.Millisecond)) {
+				allowed++
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if limiter.allow(boundary.Add(10 * time.Millisecond)) {
+				allowed++
+			}
+		}
+		if allowed > 10 {
+			t.Errorf("expected at most 10 requests allowed within 20ms, actual %d", allowed)
+		}
+	})
+
+	t.Run("previous window forgotten after idle interval", func(t *testing.T) {
+		limiter := NewSlidingWindowRateLimitStore(conf, clock.New()).newLimiter(start)
+		for i := 0; i < 10; i++ {
+			limiter.allow(start)
+		}
+		quota := limiter.quota(start.Add(2500 * time.Millisecond))
+		if quota.Remaining != 10 {
+			t.Errorf("expected full quota, actual %+v", quota)
+		}
+		if !quota.ResetAt.Equal(start.Add(3 * time.Second)) {
+			t.Errorf("expected window end at %s, actual %s", start.Add(3*time.Second), quota.ResetAt)
+		}
+	})
+}
+
+func TestSlidingRateLimitStores(t *testing.T) {
+	conf := configs.Config{
+		RequestLimit:    2,
+		TimeInterval:    200 * time.Millisecond,
+		BlockingTimeout: 300 * time.Millisecond,
+	}
+	stores := map[string]func(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore{
+		configs.AlgorithmSlidingLog:    NewSlidingLogRateLimitStore,
+		configs.AlgorithmSlidingWindow: NewSlidingWindowRateLimitStore,
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			clk := clock.NewFake(testStart)
+			limiterStore := newStore(conf, clk)
+			for i := 0; i < 2; i++ {
+				if decision, _ := limiterStore.Take(subnet); !decision.Allowed {
+					t.Errorf("expected request %d allowed", i+1)
+				}
+			}
+			if decision, _ := limiterStore.Take(subnet); decision.Allowed {
+				t.Errorf("expected blocked after exceeding limit")
+			}
+			if decision, _ := limiterStore.Take("other"); !decision.Allowed {
+				t.Errorf("expected other subnet not to be blocked")
+			}
+
+			clk.Advance(299 * time.Millisecond)
+			if decision, _ := limiterStore.Take(subnet); decision.Allowed {
+				t.Errorf("expected blocked right before blocking timeout")
+			}
+			// the blocking timeout also covers the previous window of the sliding window counter
+			clk.Advance(time.Millisecond)
+			if decision, _ := limiterStore.Take(subnet); !decision.Allowed {
+				t.Errorf("expected unblocked after blocking timeout")
+			}
+
+			limiterStore.Take(subnet)
+			limiterStore.Take(subnet)
+			limiterStore.Reset(subnet)
+			if decision, _ := limiterStore.Take(subnet); !decision.Allowed {
+				t.Errorf("expected unblocked after resetting")
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// limiterState is the state of a subnetLimiter saved to snapshots, every algorithm uses its own subset of the fields.
+type limiterState struct {
+	Count        int       `json:"count,omitempty"`
+	PrevCount    int       `json:"prev_count,omitempty"`
+	Tokens       float64   `json:"tokens,omitempty"`
+	Log          []int64   `json:"log,omitempty"`
+	TAT          int64     `json:"tat,omitempty"`
+	ResetAt      time.Time `json:"reset_at,omitempty"`
+	WindowStart  time.Time `json:"window_start,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at,omitempty"`
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+}
+
+type subnetSnapshot struct {
+	Subnet   string       `json:"subnet"`
+	LastSeen time.Time    `json:"last_seen"`
+	State    limiterState `json:"state"`
+}
+
+type storeSnapshot struct {
+	Algorithm string           `json:"algorithm"`
+	TakenAt   time.Time        `json:"taken_at"`
+	Subnets   []subnetSnapshot `json:"subnets"`
+}
+
+// WriteSnapshot writes the counters and blocks of all subnets as JSON.
+// Shards are locked one by one, so the snapshot is consistent per subnet only.
+func (i *InMemoryStoreRateLimitStore) WriteSnapshot(w io.Writer) error {
+	snapshot := storeSnapshot{Algorithm: i.algorithm, TakenAt: i.clock.Now()}
+	for _, s := range i.shards {
+		s.Lock()
+		for _, entry := range s.lru.entries() {
+			snapshot.Subnets = append(snapshot.Subnets, subnetSnapshot{
+				Subnet:   entry.subnet,
+				LastSeen: entry.lastSeen,
+				State:    s.limiters[entry.subnet].state(),
+			})
+		}
+		s.Unlock()
+	}
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// ReadSnapshot restores the subnets written by WriteSnapshot. Subnets idle longer than the idle timeout are skipped,
+// windows and blocks expired since the snapshot expire lazily like in a running store.
+func (i *InMemoryStoreRateLimitStore) ReadSnapshot(r io.Reader) error {
+	var snapshot storeSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	if snapshot.Algorithm != i.algorithm {
+		return fmt.Errorf("snapshot of algorithm %q can not be restored by %q store", snapshot.Algorithm, i.algorithm)
+	}
+	// the least recently seen first, so that the eviction order is kept
+	sort.SliceStable(snapshot.Subnets, func(a, b int) bool {
+		return snapshot.Subnets[a].LastSeen.Before(snapshot.Subnets[b].LastSeen)
+	})
+	now := i.clock.Now()
+	for _, subnet := range snapshot.Subnets {
+		if now.Sub(subnet.LastSeen) > i.idle {
+			continue
+		}
+		s := i.shardOf(subnet.Subnet)
+		s.Lock()
+		if _, ok := s.limiters[subnet.Subnet]; !ok {
+			i.evictOverCapacity(s)
+		}
+		limiter := i.newLimiter(now)
+		limiter.restore(subnet.State)
+		s.limiters[subnet.Subnet] = limiter
+		s.lru.touch(subnet.Subnet, subnet.LastSeen)
+		s.Unlock()
+	}
+	return nil
+}
+
+// SaveSnapshot writes the snapshot to the file. It is written to a temporary file first and renamed,
+// so a crash while saving leaves the previous snapshot intact.
+func (i *InMemoryStoreRateLimitStore) SaveSnapshot(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := i.WriteSnapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores the snapshot saved to the file, a missing file is not an error.
+func (i *InMemoryStoreRateLimitStore) LoadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return i.ReadSnapshot(file)
+}
+
+// SaveSnapshotsEvery saves the snapshot to the file every interval until the returned function is called.
+// The function saves the final snapshot, it waits for the snapshot being saved.
+func (i *InMemoryStoreRateLimitStore) SaveSnapshotsEvery(path string, interval time.Duration) (stop func()) {
+	save := func() {
+		if err := i.SaveSnapshot(path); err != nil {
+			log.Printf("saving snapshot to %s: %v", path, err)
+		}
+	}
+	stopSaving := repeat(i.clock, interval, save)
+	return func() {
+		stopSaving()
+		save()
+	}
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sameQuota(a, b Quota) bool {
+	return a.Limit == b.Limit && a.Remaining == b.Remaining && a.ResetAt.Equal(b.ResetAt) && a.BlockedUntil.Equal(b.BlockedUntil)
+}
+
+func TestSnapshot(t *testing.T) {
+	conf := configs.Config{
+		RequestLimit:    2,
+		TimeInterval:    time.Minute,
+		BlockingTimeout: 10 * time.Minute,
+	}
+	stores := map[string]func(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore{
+		configs.AlgorithmFixedWindow:   NewInMemoryStoreRateLimitStore,
+		configs.AlgorithmTokenBucket:   NewTokenBucketRateLimitStore,
+		configs.AlgorithmSlidingLog:    NewSlidingLogRateLimitStore,
+		configs.AlgorithmSlidingWindow: NewSlidingWindowRateLimitStore,
+		configs.AlgorithmGCRA:          NewGCRARateLimitStore,
+	}
+
+	for name, newStore := range stores {
+		t.Run("blocks survive restart "+name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			clk := clock.NewFake(testStart)
+			inMemStore := newStore(conf, clk)
+			for i := 0; i < 3; i++ {
+				inMemStore.Take(subnet)
+			}
+			inMemStore.Take("other")
+			blockedQuota, _ := inMemStore.Status(subnet)
+			otherQuota, _ := inMemStore.Status("other")
+			if err := inMemStore.SaveSnapshot(path); err != nil {
+				t.Fatal(err)
+			}
+
+			restored := newStore(conf, clk)
+			if err := restored.LoadSnapshot(path); err != nil {
+				t.Fatal(err)
+			}
+			if quota, _ := restored.Status(subnet); !sameQuota(quota, blockedQuota) {
+				t.Errorf("expected blocked subnet restored as %+v, actual %+v", blockedQuota, quota)
+			}
+			if quota, _ := restored.Status("other"); !sameQuota(quota, otherQuota) {
+				t.Errorf("expected counter restored as %+v, actual %+v", otherQuota, quota)
+			}
+
+			clk.Advance(9 * time.Minute)
+			if decision, _ := restored.Take(subnet); decision.Allowed || decision.RetryAfter != time.Minute {
+				t.Errorf("expected subnet blocked until the blocking timeout, actual %+v", decision)
+			}
+			clk.Advance(time.Minute)
+			if decision, _ := restored.Take(subnet); !decision.Allowed {
+				t.Errorf("expected subnet unblocked after the blocking timeout, actual %+v", decision)
+			}
+		})
+	}
+
+	t.Run("idle subnets skipped", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "snapshot.json")
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(conf, clk)
+		inMemStore.Take(subnet)
+		if err := inMemStore.SaveSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+
+		clk.Advance(inMemStore.idle + time.Millisecond)
+		restored := NewInMemoryStoreRateLimitStore(conf, clk)
+		if err := restored.LoadSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+		if n := restored.tracked(); n != 0 {
+			t.Errorf("expected idle subnet not restored, actual %d subnets", n)
+		}
+	})
+
+	t.Run("algorithm mismatch", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "snapshot.json")
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(conf, clk)
+		inMemStore.Take(subnet)
+		if err := inMemStore.SaveSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := NewGCRARateLimitStore(conf, clk)
+		if err := restored.LoadSnapshot(path); err == nil {
+			t.Errorf("expected error restoring snapshot of another algorithm")
+		}
+		if n := restored.tracked(); n != 0 {
+			t.Errorf("expected no subnets restored, actual %d", n)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		inMemStore := NewInMemoryStoreRateLimitStore(conf, clock.NewFake(testStart))
+		if err := inMemStore.LoadSnapshot(filepath.Join(t.TempDir(), "snapshot.json")); err != nil {
+			t.Errorf("expected missing snapshot ignored, actual %v", err)
+		}
+	})
+
+	t.Run("saved periodically and on stop", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "snapshot.json")
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(conf, clk)
+		stop := inMemStore.SaveSnapshotsEvery(path, time.Minute)
+
+		inMemStore.Take(subnet)
+		clk.Advance(time.Minute - time.Millisecond)
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("expected no snapshot before the interval")
+		}
+		clk.Advance(time.Millisecond)
+		restored := NewInMemoryStoreRateLimitStore(conf, clk)
+		if err := restored.LoadSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+		if n := restored.tracked(); n != 1 {
+			t.Errorf("expected snapshot saved after the interval, actual %d subnets", n)
+		}
+
+		inMemStore.Take("other")
+		stop()
+		if clk.Pending() != 0 {
+			t.Errorf("expected no snapshots scheduled after stop")
+		}
+		restored = NewInMemoryStoreRateLimitStore(conf, clk)
+		if err := restored.LoadSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+		if n := restored.tracked(); n != 2 {
+			t.Errorf("expected snapshot saved on stop, actual %d subnets", n)
+		}
+	})
+}
@@ -1,7 +1,7 @@
 package store
 
 import (
-	"context"
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
 	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
 	"log"
 	"sync"
@@ -9,188 +9,361 @@ import (
 )
 
 type RateLimitStore interface {
-	Check(subnet string) bool
-	Reset(subnet string)
+	// Take counts the request of the subnet and decides whether it is allowed in one atomic step,
+	// so that exactly the limit of requests per window is allowed.
+	Take(subnet string) (Decision, error)
+	// Reset forgets the requests and the block of the subnet and reports whether the subnet was tracked.
+	Reset(subnet string) (bool, error)
+	// Subnets returns the state of the subnets tracked by the store in no particular order.
+	Subnets() ([]SubnetState, error)
 }
 
-type SubnetBlocksMap struct {
-	sync.RWMutex
-	m map[string]bool
+// SubnetState is the state of a subnet tracked by the store.
+type SubnetState struct {
+	Subnet string
+	Quota
+	// Count is the number of requests counted in the current window, for token bucket and GCRA the used part of the burst.
+	Count int
+	// BlockedAt is the time the subnet got blocked, zero if the subnet is not blocked.
+	BlockedAt time.Time
 }
 
-type SubnetCountMap struct {
-	sync.Mutex
-	m map[string]int
+// Decision is the outcome of taking a request from the quota of a subnet.
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAt is the time the current counting window ends.
+	ResetAt time.Time
+	// RetryAfter is the time left until the subnet gets unblocked, zero for allowed requests.
+	RetryAfter time.Duration
+}
+
+// Quota returns the quota of the subnet after the decision made at now.
+func (d Decision) Quota(now time.Time) Quota {
+	quota := Quota{Limit: d.Limit, Remaining: d.Remaining, ResetAt: d.ResetAt}
+	if !d.Allowed {
+		quota.Remaining = 0
+		quota.BlockedUntil = now.Add(d.RetryAfter)
+	}
+	return quota
+}
+
+// Quota describes the state of the request quota of a subnet.
+type Quota struct {
+	Limit     int
+	Remaining int
+	// ResetAt is the time the current counting window ends.
+	ResetAt time.Time
+	// BlockedUntil is the time the subnet gets unblocked, zero if the subnet is not blocked.
+	BlockedUntil time.Time
+}
+
+// ResetAfter returns the time left until the quota is restored, for blocked subnets it is the remaining blocking time.
+func (q Quota) ResetAfter(now time.Time) time.Duration {
+	resetAt := q.ResetAt
+	if !q.BlockedUntil.IsZero() {
+		resetAt = q.BlockedUntil
+	}
+	if d := resetAt.Sub(now); d > 0 {
+		return d
+	}
+	return 0
 }
 
-type SubnetTimer struct {
-	timer  *time.Timer
-	subnet string
+// subnetLimiter keeps the rate limiting state of a single subnet for one algorithm.
+// The state is computed lazily from the time of the call, limiters need no timers.
+type subnetLimiter interface {
+	// allow counts the request made at now if it fits the limit and reports whether it does.
+	allow(now time.Time) bool
+	// block blocks the subnet until the time.
+	block(now time.Time, until time.Time)
+	// blockedUntil returns the end of blocking, zero if the subnet is not blocked at now.
+	blockedUntil(now time.Time) time.Time
+	quota(now time.Time) Quota
+	// state returns the state saved to snapshots
+	state() limiterState
+	// restore sets the state loaded from a snapshot
+	restore(state limiterState)
 }
 
+const (
+	maxShards = 64
+	// minShardSubnets limits the number of shards for small capacities,
+	// the least recently seen subnet is evicted per shard
+	minShardSubnets = 16
+)
+
+type shard struct {
+	sync.Mutex
+	limiters map[string]subnetLimiter
+	lru      *subnetLRU
+}
+
+// InMemoryStoreRateLimitStore keeps a subnetLimiter of the configured algorithm per subnet in memory.
+// A subnet exceeding the limit is blocked for the blocking timeout.
+//
+// Subnets are spread over shards locked separately, so that checks of different subnets rarely wait for each other.
+// Windows and blocks expire lazily on the next request, subnets without requests for the idle timeout are forgotten
+// and over maxSubnets the least recently seen are evicted. The store starts no goroutines or timers.
 type InMemoryStoreRateLimitStore struct {
-	subnetBlocksMap SubnetBlocksMap
-	subnetCountMap  SubnetCountMap
-	reqLimit        int
-	timeLimit       time.Duration
-	timeout         time.Duration
-
-	reqEventCh       chan string
-	resetTimeLimitCh chan SubnetTimer
-	resetCounterCh   chan string
-
-	unlockTimeLimitCh chan SubnetTimer
-	resetTimerCh      chan SubnetTimer
-
-	blockSubnetCh   chan string
-	unblockSubnetCh chan string
-
-	ctx    context.Context
-	cancel context.CancelFunc
-}
-
-func (i *InMemoryStoreRateLimitStore) Check(subnet string) bool {
-	i.subnetBlocksMap.RLock()
-	isBlocked, _ := i.subnetBlocksMap.m[subnet]
-	i.subnetBlocksMap.RUnlock()
-	log.Printf("Request for subnet %s isBlocked: %t", subnet, isBlocked)
-	if !isBlocked {
-		i.reqEventCh <- subnet
-	}
-	return isBlocked
-}
-
-func (i *InMemoryStoreRateLimitStore) startReqEventListener() {
-	go func() {
-		for {
-			select {
-			case subnet := <-i.reqEventCh:
-				count, inMap := i.subnetCountMap.m[subnet]
-				if !inMap {
-					log.Printf("reqEventListener create timer to reset counter for subnet %s", subnet)
-					i.resetTimerCh <- SubnetTimer{
-						timer:  time.NewTimer(i.timeLimit),
-						subnet: subnet,
-					}
-				}
-				log.Printf("reqEventListener got event : subnet %s requestCount %d/%d", subnet, count+1, i.reqLimit)
-				i.subnetCountMap.m[subnet] = count + 1
-
-				if i.subnetCountMap.m[subnet] > i.reqLimit {
-					i.blockSubnet(subnet)
-				}
-			case subnet := <-i.resetCounterCh:
-				_, inMap := i.subnetCountMap.m[subnet]
-				if inMap {
-					i.subnetCountMap.m[subnet] = 0
-				}
-			case <-i.ctx.Done():
-				log.Println("Cancelled ReqEventListener")
-				return
-			}
-		}
-	}()
-}
-
-func (i *InMemoryStoreRateLimitStore) startResetListener() {
-	go func() {
-		for {
-			select {
-			case subnetTimer := <-i.resetTimerCh:
-				<-subnetTimer.timer.C
-				log.Printf("resetting counter for subnet %s", subnetTimer.subnet)
-				i.resetCounterCh <- subnetTimer.subnet
-				i.resetTimerCh <- SubnetTimer{
-					timer:  time.NewTimer(i.timeLimit),
-					subnet: subnetTimer.subnet,
-				}
-			case <-i.ctx.Done():
-				log.Println("Cancelled ResetListener")
-				return
-			}
+	limiterFactory
+	shards      []*shard
+	timeout     time.Duration
+	idle        time.Duration
+	maxPerShard int
+	clock       clock.Clock
+}
+
+// limiterFactory creates the subnetLimiters of one algorithm.
+type limiterFactory struct {
+	algorithm  string
+	newLimiter func(now time.Time) subnetLimiter
+	// restAfter is the time an untouched limiter takes to return to the state of a new one
+	restAfter time.Duration
+}
+
+// idleTimeout returns the time subnets are kept without requests, at least the blocking timeout plus restAfter,
+// so that forgetting them does not change the decisions.
+func (l limiterFactory) idleTimeout(conf configs.Config) time.Duration {
+	idle := conf.BlockingTimeout + l.restAfter
+	if conf.IdleTimeout > idle {
+		idle = conf.IdleTimeout
+	}
+	return idle
+}
+
+func fixedWindowLimiters(conf configs.Config) limiterFactory {
+	return limiterFactory{
+		algorithm: configs.AlgorithmFixedWindow,
+		newLimiter: func(now time.Time) subnetLimiter {
+			return &fixedWindow{limit: conf.RequestLimit, interval: conf.TimeInterval}
+		},
+		restAfter: conf.TimeInterval,
+	}
+}
+
+// NewInMemoryStoreRateLimitStore creates the store counting requests in fixed windows.
+func NewInMemoryStoreRateLimitStore(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore {
+	return newInMemoryStore(conf, clk, fixedWindowLimiters(conf))
+}
+
+func newInMemoryStore(conf configs.Config, clk clock.Clock, factory limiterFactory) *InMemoryStoreRateLimitStore {
+	shardsCount := maxShards
+	maxPerShard := 0
+	if conf.MaxSubnets > 0 {
+		if n := conf.MaxSubnets / minShardSubnets; n < shardsCount {
+			shardsCount = n
 		}
-	}()
-}
-
-func (i *InMemoryStoreRateLimitStore) startBlockListener() {
-	go func() {
-		for {
-			select {
-			case subnet := <-i.blockSubnetCh:
-				log.Printf("blocking for subnet %s", subnet)
-				i.subnetBlocksMap.Lock()
-				i.subnetBlocksMap.m[subnet] = true
-				i.subnetBlocksMap.Unlock()
-			case subnet := <-i.unblockSubnetCh:
-				log.Printf("unblocking for subnet %s", subnet)
-				i.subnetBlocksMap.Lock()
-				i.subnetBlocksMap.m[subnet] = false
-				i.subnetBlocksMap.Unlock()
-			case <-i.ctx.Done():
-				log.Println("Cancelled BlockListener")
-				return
-			}
+		if shardsCount < 1 {
+			shardsCount = 1
 		}
-	}()
+		maxPerShard = conf.MaxSubnets / shardsCount
+	}
+	shards := make([]*shard, shardsCount)
+	for i := range shards {
+		shards[i] = &shard{limiters: make(map[string]subnetLimiter), lru: newSubnetLRU()}
+	}
+	return &InMemoryStoreRateLimitStore{
+		limiterFactory: factory,
+		shards:         shards,
+		timeout:        conf.BlockingTimeout,
+		idle:           factory.idleTimeout(conf),
+		maxPerShard:    maxPerShard,
+		clock:          clk,
+	}
 }
 
-func (i *InMemoryStoreRateLimitStore) Reset(subnet string) {
-	log.Printf("resetting blocking and request counter for subnet %s", subnet)
-	i.resetCounterCh <- subnet
-	i.unblockSubnetCh <- subnet
+func (i *InMemoryStoreRateLimitStore) Take(subnet string) (Decision, error) {
+	now := i.clock.Now()
+	s := i.shardOf(subnet)
+	s.Lock()
+	defer s.Unlock()
+
+	i.evictIdle(s, now)
+	limiter, ok := s.limiters[subnet]
+	if !ok {
+		i.evictOverCapacity(s)
+		limiter = i.newLimiter(now)
+		s.limiters[subnet] = limiter
+	}
+	s.lru.touch(subnet, now)
+	return take(limiter, subnet, now, i.timeout), nil
 }
 
-func (i *InMemoryStoreRateLimitStore) blockSubnet(subnet string) {
-	i.blockSubnetCh <- subnet
-	i.unlockTimeLimitCh <- SubnetTimer{
-		timer:  time.NewTimer(i.timeout),
-		subnet: subnet,
+// Status returns the quota of the subnet without counting a request.
+func (i *InMemoryStoreRateLimitStore) Status(subnet string) (Quota, error) {
+	now := i.clock.Now()
+	s := i.shardOf(subnet)
+	s.Lock()
+	defer s.Unlock()
+
+	limiter, ok := s.limiters[subnet]
+	if !ok {
+		limiter = i.newLimiter(now)
 	}
+	return status(limiter, now), nil
 }
 
-func (i *InMemoryStoreRateLimitStore) startUnBlockTimerListener() {
+func (i *InMemoryStoreRateLimitStore) Reset(subnet string) (bool, error) {
+	log.Printf("resetting blocking and request counter for subnet %s", subnet)
+	now := i.clock.Now()
+	s := i.shardOf(subnet)
+	s.Lock()
+	defer s.Unlock()
+
+	lastSeen, ok := s.lru.lastSeen(subnet)
+	s.delete(subnet)
+	return ok && now.Sub(lastSeen) <= i.idle, nil
+}
 
-	go func() {
-		for {
-			select {
-			case subnetTimer := <-i.unlockTimeLimitCh:
-				<-subnetTimer.timer.C
-				i.unblockSubnetCh <- subnetTimer.subnet
-			case <-i.ctx.Done():
-				log.Println("Cancelled UnBlockTimerListener")
-				return
+func (i *InMemoryStoreRateLimitStore) Subnets() ([]SubnetState, error) {
+	now := i.clock.Now()
+	var res []SubnetState
+	for _, s := range i.shards {
+		s.Lock()
+		for subnet, limiter := range s.limiters {
+			// idle subnets are evicted lazily
+			if lastSeen, ok := s.lru.lastSeen(subnet); ok && now.Sub(lastSeen) > i.idle {
+				continue
 			}
+			res = append(res, subnetState(subnet, limiter, now, i.timeout))
 		}
-	}()
+		s.Unlock()
+	}
+	return res, nil
 }
 
-func (i *InMemoryStoreRateLimitStore) InitStore() {
-	i.startReqEventListener()
-	i.startBlockListener()
-	i.startUnBlockTimerListener()
-	i.startResetListener()
+// shardOf hashes the subnet with FNV-1a
+func (i *InMemoryStoreRateLimitStore) shardOf(subnet string) *shard {
+	hash := uint32(2166136261)
+	for j := 0; j < len(subnet); j++ {
+		hash ^= uint32(subnet[j])
+		hash *= 16777619
+	}
+	return i.shards[hash%uint32(len(i.shards))]
 }
 
-func (i *InMemoryStoreRateLimitStore) CloseStore() {
-	i.cancel()
+// evictIdle forgets the subnets of the shard seen before the idle timeout, the least recently seen first.
+// Must be called with the shard locked.
+func (i *InMemoryStoreRateLimitStore) evictIdle(s *shard, now time.Time) {
+	for {
+		oldest, ok := s.lru.oldest()
+		if !ok || now.Sub(oldest.lastSeen) <= i.idle {
+			return
+		}
+		s.delete(oldest.subnet)
+		evictedSubnets.WithLabelValues(evictExpired).Inc()
+	}
 }
 
-func NewInMemoryStoreRateLimitStore(conf configs.Config) *InMemoryStoreRateLimitStore {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &InMemoryStoreRateLimitStore{
-		subnetBlocksMap:   SubnetBlocksMap{m: make(map[string]bool)},
-		subnetCountMap:    SubnetCountMap{m: make(map[string]int)},
-		reqLimit:          conf.RequestLimit,
-		timeLimit:         conf.TimeInterval,
-		timeout:           conf.BlockingTimeout,
-		reqEventCh:        make(chan string, 1000),
-		resetTimeLimitCh:  make(chan SubnetTimer, 1000),
-		resetCounterCh:    make(chan string, 1000),
-		unlockTimeLimitCh: make(chan SubnetTimer, 1000),
-		resetTimerCh:      make(chan SubnetTimer, 1000),
-		blockSubnetCh:     make(chan string, 1000),
-		unblockSubnetCh:   make(chan string, 1000),
-		ctx:               ctx,
-		cancel:            cancel,
+// evictOverCapacity forgets the least recently seen subnet of the shard if it is full,
+// the evicted subnet starts with a fresh quota. Must be called with the shard locked.
+func (i *InMemoryStoreRateLimitStore) evictOverCapacity(s *shard) {
+	if i.maxPerShard <= 0 || s.lru.len() < i.maxPerShard {
+		return
+	}
+	if oldest, ok := s.lru.oldest(); ok {
+		log.Printf("evicting subnet %s over capacity of %d subnets per shard", oldest.subnet, i.maxPerShard)
+		s.delete(oldest.subnet)
+		evictedSubnets.WithLabelValues(evictCapacity).Inc()
+	}
+}
+
+// delete must be called with the shard locked
+func (s *shard) delete(subnet string) {
+	delete(s.limiters, subnet)
+	s.lru.remove(subnet)
+}
+
+// take counts the request made at now by the limiter of the subnet, the subnet exceeding the limit is blocked for the timeout.
+func take(limiter subnetLimiter, subnet string, now time.Time, timeout time.Duration) Decision {
+	if until := limiter.blockedUntil(now); !until.IsZero() {
+		return newDecision(limiter.quota(now), now, false, until)
+	}
+	if !limiter.allow(now) {
+		log.Printf("blocking for subnet %s", subnet)
+		until := now.Add(timeout)
+		limiter.block(now, until)
+		return newDecision(limiter.quota(now), now, false, until)
+	}
+	return newDecision(limiter.quota(now), now, true, time.Time{})
+}
+
+func status(limiter subnetLimiter, now time.Time) Quota {
+	quota := limiter.quota(now)
+	quota.BlockedUntil = limiter.blockedUntil(now)
+	if !quota.BlockedUntil.IsZero() {
+		quota.Remaining = 0
+	}
+	return quota
+}
+
+// subnetState describes the limiter of the subnet, the block started the timeout before it ends
+func subnetState(subnet string, limiter subnetLimiter, now time.Time, timeout time.Duration) SubnetState {
+	quota := limiter.quota(now)
+	state := SubnetState{Subnet: subnet, Quota: status(limiter, now), Count: quota.Limit - quota.Remaining}
+	if !state.BlockedUntil.IsZero() {
+		state.BlockedAt = state.BlockedUntil.Add(-timeout)
+	}
+	return state
+}
+
+// newDecision makes the decision with the quota left after the request, denied requests are retried after blocking.
+func newDecision(quota Quota, now time.Time, allowed bool, blockedUntil time.Time) Decision {
+	decision := Decision{
+		Allowed:   allowed,
+		Limit:     quota.Limit,
+		Remaining: quota.Remaining,
+		ResetAt:   quota.ResetAt,
+	}
+	if !allowed {
+		decision.Remaining = 0
+		if blockedUntil.After(now) {
+			decision.RetryAfter = blockedUntil.Sub(now)
+		}
+	}
+	return decision
+}
+
+func newQuota(limit int, count int, resetAt time.Time, blockedUntil time.Time) Quota {
+	remaining := limit - count
+	if remaining < 0 || !blockedUntil.IsZero() {
+		remaining = 0
+	}
+	return Quota{
+		Limit:        limit,
+		Remaining:    remaining,
+		ResetAt:      resetAt,
+		BlockedUntil: blockedUntil,
+	}
+}
+
+// repeat calls f every interval of the clock until the returned function is called,
+// the function waits for the running call of f.
+func repeat(clk clock.Clock, interval time.Duration, f func()) (stop func()) {
+	var (
+		mu      sync.Mutex
+		timer   clock.Timer
+		stopped bool
+		run     func()
+	)
+	run = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		f()
+		timer = clk.AfterFunc(interval, run)
+	}
+	mu.Lock()
+	timer = clk.AfterFunc(interval, run)
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		timer.Stop()
 	}
 }
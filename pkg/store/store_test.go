@@ -1,139 +1,232 @@
 package store
 
 import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
 	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 const subnet = "subnet"
 
-func initStore(config configs.Config) (*InMemoryStoreRateLimitStore, func()) {
-	inMemStore := NewInMemoryStoreRateLimitStore(config)
-	inMemStore.InitStore()
-	return inMemStore, func() {
-		inMemStore.CloseStore()
-	}
-}
+var testStart = time.Unix(1000, 0)
 
 func TestNewInMemoryStoreRateLimitStoreName(t *testing.T) {
 
 	t.Run("ok case ", func(t *testing.T) {
-		inMemStore, closeStore := initStore(configs.Config{
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(configs.Config{
 			RequestLimit:    1,
 			TimeInterval:    300 * time.Millisecond,
 			BlockingTimeout: 3 * time.Second,
-		})
-		defer closeStore()
+		}, clk)
 
-		res := inMemStore.Check(subnet)
-		if res {
+		decision, _ := inMemStore.Take(subnet)
+		if !decision.Allowed {
 			t.Errorf("expected false for 1 req of 1 max per 1 second")
 		}
-		time.Sleep(500 * time.Millisecond)
-		res = inMemStore.Check(subnet)
-		if res {
+		clk.Advance(500 * time.Millisecond)
+		decision, _ = inMemStore.Take(subnet)
+		if !decision.Allowed {
 			t.Errorf("expected false for 1 req of 1 max per 1 second")
 		}
-		time.Sleep(500 * time.Millisecond)
-		res = inMemStore.Check(subnet)
-		if res {
+		clk.Advance(500 * time.Millisecond)
+		decision, _ = inMemStore.Take(subnet)
+		if !decision.Allowed {
 			t.Errorf("expected false for 1 req of 1 max per 1 second")
 		}
 	})
 
 	t.Run("block ", func(t *testing.T) {
-		inMemStore, closeStore := initStore(configs.Config{
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(configs.Config{
 			RequestLimit:    1,
 			TimeInterval:    3 * time.Second,
 			BlockingTimeout: 3 * time.Second,
-		})
-		defer closeStore()
+		}, clk)
 
-		res := inMemStore.Check(subnet)
-		if res {
+		decision, _ := inMemStore.Take(subnet)
+		if !decision.Allowed {
 			t.Errorf("expected false for 1 req of 1 max per 1 second")
 		}
-		inMemStore.Check(subnet)
-
-		time.Sleep(100 * time.Millisecond)
+		decision, _ = inMemStore.Take(subnet)
+		if decision.Allowed {
+			t.Errorf("expected request over the limit blocked")
+		}
 
-		res = inMemStore.Check(subnet)
-		if !res {
+		decision, _ = inMemStore.Take(subnet)
+		if decision.Allowed {
 			t.Errorf("expected false for 1 req of 1 max per 1 second")
 		}
 	})
 
 	t.Run("block on blocking timeout ", func(t *testing.T) {
-		inMemStore, closeStore := initStore(configs.Config{
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(configs.Config{
 			RequestLimit:    1,
 			TimeInterval:    300 * time.Millisecond,
 			BlockingTimeout: 3 * time.Second,
-		})
-		defer closeStore()
+		}, clk)
 
-		res := inMemStore.Check(subnet)
-		if res {
+		decision, _ := inMemStore.Take(subnet)
+		if !decision.Allowed {
 			t.Errorf("expected false for 1 req of 1 max per 1 second")
 		}
-		inMemStore.Check(subnet)
-		inMemStore.Check(subnet)
-
-		time.Sleep(100 * time.Millisecond)
-
-		ticker := time.NewTicker(800 * time.Millisecond)
-		timer := time.NewTimer(2950 * time.Millisecond)
-
-		for loop := true; loop; {
-			select {
-			case <-ticker.C:
-				res := inMemStore.Check(subnet)
-				if !res {
-					t.Errorf("expected blocked")
-				}
-			case <-timer.C:
-				loop = false
-				ticker.Stop()
-				break
+		inMemStore.Take(subnet)
+		inMemStore.Take(subnet)
+
+		for i := 0; i < 3; i++ {
+			clk.Advance(800 * time.Millisecond)
+			decision, _ := inMemStore.Take(subnet)
+			if decision.Allowed {
+				t.Errorf("expected blocked")
 			}
 		}
+		clk.Advance(599 * time.Millisecond)
+		decision, _ = inMemStore.Take(subnet)
+		if decision.Allowed {
+			t.Errorf("expected blocked right before timeout")
+		}
 
-		res = inMemStore.Check(subnet)
-		if res {
+		clk.Advance(time.Millisecond)
+		decision, _ = inMemStore.Take(subnet)
+		if !decision.Allowed {
 			t.Errorf("expected unblocked after timeout")
 		}
 	})
 
 	t.Run("block on blocking timeout ", func(t *testing.T) {
-		inMemStore, closeStore := initStore(configs.Config{
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(configs.Config{
 			RequestLimit:    1,
 			TimeInterval:    300 * time.Millisecond,
 			BlockingTimeout: 5 * time.Second,
-		})
-		defer closeStore()
+		}, clk)
 
-		res := inMemStore.Check(subnet)
-		if res {
+		decision, _ := inMemStore.Take(subnet)
+		if !decision.Allowed {
 			t.Errorf("expected false for 1 req of 1 max per 1 second")
 		}
-		inMemStore.Check(subnet)
-		inMemStore.Check(subnet)
-		inMemStore.Check(subnet)
-		inMemStore.Check(subnet)
-		time.Sleep(100 * time.Millisecond)
+		inMemStore.Take(subnet)
+		inMemStore.Take(subnet)
+		inMemStore.Take(subnet)
+		inMemStore.Take(subnet)
 
-		res = inMemStore.Check(subnet)
-		if !res {
+		decision, _ = inMemStore.Take(subnet)
+		if decision.Allowed {
 			t.Errorf("expected blocked after spam requests")
 		}
 
 		inMemStore.Reset(subnet)
-		time.Sleep(100 * time.Millisecond)
 
-		res = inMemStore.Check(subnet)
-		if res {
+		decision, _ = inMemStore.Take(subnet)
+		if !decision.Allowed {
 			t.Errorf("expected unblocked after resetting")
 		}
 	})
 
+	t.Run("counter reset at window end ", func(t *testing.T) {
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(configs.Config{
+			RequestLimit:    2,
+			TimeInterval:    time.Second,
+			BlockingTimeout: 5 * time.Second,
+		}, clk)
+
+		inMemStore.Take(subnet)
+		inMemStore.Take(subnet)
+
+		clk.Advance(999 * time.Millisecond)
+		if quota, _ := inMemStore.Status(subnet); quota.Remaining != 0 {
+			t.Errorf("expected no remaining requests before window end, actual %+v", quota)
+		}
+		clk.Advance(time.Millisecond)
+		if quota, _ := inMemStore.Status(subnet); quota.Remaining != 2 {
+			t.Errorf("expected quota restored at window end, actual %+v", quota)
+		}
+	})
+
+	t.Run("status ", func(t *testing.T) {
+		clk := clock.NewFake(testStart)
+		inMemStore := NewInMemoryStoreRateLimitStore(configs.Config{
+			RequestLimit:    2,
+			TimeInterval:    3 * time.Second,
+			BlockingTimeout: 5 * time.Second,
+		}, clk)
+
+		quota, _ := inMemStore.Status(subnet)
+		if quota.Limit != 2 || quota.Remaining != 2 || !quota.BlockedUntil.IsZero() {
+			t.Errorf("expected full quota for unknown subnet, actual %+v", quota)
+		}
+
+		inMemStore.Take(subnet)
+		quota, _ = inMemStore.Status(subnet)
+		if !quota.ResetAt.Equal(testStart.Add(3 * time.Second)) {
+			t.Errorf("expected reset at the end of interval, actual %s", quota.ResetAt)
+		}
+
+		clk.Advance(time.Second)
+		inMemStore.Take(subnet)
+		inMemStore.Take(subnet)
+		quota, _ = inMemStore.Status(subnet)
+		if quota.Remaining != 0 {
+			t.Errorf("expected no remaining requests, actual %+v", quota)
+		}
+		if !quota.BlockedUntil.Equal(testStart.Add(6 * time.Second)) {
+			t.Errorf("expected blocked for blocking timeout, actual %s", quota.BlockedUntil)
+		}
+	})
+
+}
+
+func TestTakeConcurrent(t *testing.T) {
+	const (
+		limit      = 50
+		goroutines = 100
+		requests   = 10
+	)
+	conf := configs.Config{
+		RequestLimit:    limit,
+		TimeInterval:    time.Minute,
+		BlockingTimeout: time.Minute,
+	}
+	stores := map[string]func(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore{
+		configs.AlgorithmFixedWindow:   NewInMemoryStoreRateLimitStore,
+		configs.AlgorithmTokenBucket:   NewTokenBucketRateLimitStore,
+		configs.AlgorithmSlidingLog:    NewSlidingLogRateLimitStore,
+		configs.AlgorithmSlidingWindow: NewSlidingWindowRateLimitStore,
+		configs.AlgorithmGCRA:          NewGCRARateLimitStore,
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			inMemStore := newStore(conf, clock.NewFake(testStart))
+			if allowed := takeConcurrently(inMemStore, goroutines, requests); allowed != limit {
+				t.Errorf("expected exactly %d requests allowed, actual %d", limit, allowed)
+			}
+		})
+	}
+}
+
+// takeConcurrently takes requests of the subnet from many goroutines at once and returns the number of allowed ones
+func takeConcurrently(rateLimitStore RateLimitStore, goroutines int, requests int) int {
+	var allowed int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < requests; i++ {
+				if decision, err := rateLimitStore.Take(subnet); err == nil && decision.Allowed {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return int(allowed)
 }
@@ -0,0 +1,241 @@
+// Package storetest provides the conformance tests every store.RateLimitStore implementation has to pass.
+package storetest
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"github.com/asavt7/antibot-developer-trainee/pkg/store"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// StatusStore is a store exposing the quota of a subnet, so that the tests can inspect it.
+type StatusStore interface {
+	store.RateLimitStore
+	// Status returns the quota of the subnet without counting a request.
+	Status(subnet string) (store.Quota, error)
+}
+
+// Subject is a store under test with the control of its time.
+type Subject struct {
+	Store StatusStore
+	// Advance moves the time seen by the store forward, without sleeping if possible.
+	Advance func(d time.Duration)
+}
+
+// NewSubject creates an empty store configured by conf, the resources of the store are released by t.Cleanup.
+type NewSubject func(t *testing.T, conf configs.Config) Subject
+
+// Conf is the configuration the stores are tested with. The blocking timeout is longer than the interval,
+// so that the quota is restored once the subnet is unblocked.
+var Conf = configs.Config{
+	RequestLimit:    3,
+	TimeInterval:    time.Second,
+	BlockingTimeout: 3 * time.Second,
+}
+
+// restoreAfter is the time all the algorithms take to restore the whole quota,
+// the sliding window counter takes two intervals to forget the previous window.
+var restoreAfter = 2 * Conf.TimeInterval
+
+const subnet = "192.168.0.0/24"
+
+// Run runs the conformance tests against the stores created by newSubject.
+func Run(t *testing.T, newSubject NewSubject) {
+	t.Run("limit enforcement", func(t *testing.T) { testLimit(t, newSubject(t, Conf)) })
+	t.Run("window reset", func(t *testing.T) { testWindowReset(t, newSubject(t, Conf)) })
+	t.Run("block timeout", func(t *testing.T) { testBlockTimeout(t, newSubject(t, Conf)) })
+	t.Run("reset", func(t *testing.T) { testReset(t, newSubject(t, Conf)) })
+	t.Run("status", func(t *testing.T) { testStatus(t, newSubject(t, Conf)) })
+	t.Run("subnet isolation", func(t *testing.T) { testIsolation(t, newSubject(t, Conf)) })
+	t.Run("subnets", func(t *testing.T) { testSubnets(t, newSubject(t, Conf)) })
+	t.Run("concurrency", func(t *testing.T) {
+		conf := Conf
+		conf.RequestLimit = 50
+		testConcurrency(t, newSubject(t, conf), conf.RequestLimit)
+	})
+}
+
+func take(t *testing.T, s Subject, subnet string) store.Decision {
+	t.Helper()
+	decision, err := s.Store.Take(subnet)
+	if err != nil {
+		t.Fatalf("take for subnet %s: %v", subnet, err)
+	}
+	return decision
+}
+
+func status(t *testing.T, s Subject, subnet string) store.Quota {
+	t.Helper()
+	quota, err := s.Store.Status(subnet)
+	if err != nil {
+		t.Fatalf("status of subnet %s: %v", subnet, err)
+	}
+	return quota
+}
+
+// exhaust takes the whole quota of the subnet
+func exhaust(t *testing.T, s Subject, subnet string) {
+	t.Helper()
+	for i := 0; i < Conf.RequestLimit; i++ {
+		if decision := take(t, s, subnet); !decision.Allowed {
+			t.Fatalf("expected request %d of %d allowed, actual %+v", i+1, Conf.RequestLimit, decision)
+		}
+	}
+}
+
+func testLimit(t *testing.T, s Subject) {
+	for i := 0; i < Conf.RequestLimit; i++ {
+		decision := take(t, s, subnet)
+		if !decision.Allowed {
+			t.Fatalf("expected request %d of %d allowed, actual %+v", i+1, Conf.RequestLimit, decision)
+		}
+		if decision.Limit != Conf.RequestLimit || decision.Remaining != Conf.RequestLimit-i-1 {
+			t.Errorf("expected %d of %d requests remaining, actual %+v", Conf.RequestLimit-i-1, Conf.RequestLimit, decision)
+		}
+	}
+	decision := take(t, s, subnet)
+	if decision.Allowed {
+		t.Fatalf("expected request over the limit denied")
+	}
+	if decision.Remaining != 0 || decision.RetryAfter != Conf.BlockingTimeout {
+		t.Errorf("expected denied request retried after the blocking timeout, actual %+v", decision)
+	}
+}
+
+func testWindowReset(t *testing.T, s Subject) {
+	exhaust(t, s, subnet)
+	s.Advance(restoreAfter)
+	exhaust(t, s, subnet)
+}
+
+func testBlockTimeout(t *testing.T, s Subject) {
+	exhaust(t, s, subnet)
+	take(t, s, subnet)
+
+	s.Advance(Conf.BlockingTimeout / 2)
+	decision := take(t, s, subnet)
+	if decision.Allowed {
+		t.Fatalf("expected subnet blocked during the blocking timeout")
+	}
+	if decision.RetryAfter != Conf.BlockingTimeout/2 {
+		t.Errorf("expected retry after the rest of the blocking timeout %v, actual %+v", Conf.BlockingTimeout/2, decision)
+	}
+	if quota := status(t, s, subnet); quota.Remaining != 0 || quota.BlockedUntil.IsZero() {
+		t.Errorf("expected blocked status, actual %+v", quota)
+	}
+
+	s.Advance(Conf.BlockingTimeout / 2)
+	if decision := take(t, s, subnet); !decision.Allowed {
+		t.Errorf("expected subnet unblocked after the blocking timeout, actual %+v", decision)
+	}
+}
+
+func testReset(t *testing.T, s Subject) {
+	exhaust(t, s, subnet)
+	take(t, s, subnet)
+	if reset, err := s.Store.Reset(subnet); err != nil || !reset {
+		t.Fatalf("expected tracked subnet reset, actual %t %v", reset, err)
+	}
+	if quota := status(t, s, subnet); quota.Remaining != Conf.RequestLimit || !quota.BlockedUntil.IsZero() {
+		t.Errorf("expected whole quota after reset, actual %+v", quota)
+	}
+	exhaust(t, s, subnet)
+
+	if reset, err := s.Store.Reset("unknown"); err != nil || reset {
+		t.Errorf("expected reset of unknown subnet ignored, actual %t %v", reset, err)
+	}
+}
+
+func testStatus(t *testing.T, s Subject) {
+	if quota := status(t, s, subnet); quota.Limit != Conf.RequestLimit || quota.Remaining != Conf.RequestLimit {
+		t.Errorf("expected whole quota of new subnet, actual %+v", quota)
+	}
+	take(t, s, subnet)
+	for i := 0; i < 3; i++ {
+		if quota := status(t, s, subnet); quota.Remaining != Conf.RequestLimit-1 {
+			t.Errorf("expected status not counted as request, actual %+v", quota)
+		}
+	}
+}
+
+func testIsolation(t *testing.T, s Subject) {
+	const other = "192.168.1.0/24"
+	exhaust(t, s, subnet)
+	take(t, s, subnet)
+	take(t, s, other)
+
+	if quota := status(t, s, other); quota.Remaining != Conf.RequestLimit-1 || !quota.BlockedUntil.IsZero() {
+		t.Errorf("expected other subnet unaffected by blocking, actual %+v", quota)
+	}
+	if _, err := s.Store.Reset(subnet); err != nil {
+		t.Fatal(err)
+	}
+	if quota := status(t, s, other); quota.Remaining != Conf.RequestLimit-1 {
+		t.Errorf("expected other subnet unaffected by reset, actual %+v", quota)
+	}
+}
+
+func testSubnets(t *testing.T, s Subject) {
+	const other = "192.168.1.0/24"
+	exhaust(t, s, subnet)
+	take(t, s, subnet)
+	take(t, s, other)
+
+	subnets, err := s.Store.Subnets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[string]store.SubnetState)
+	for _, state := range subnets {
+		states[state.Subnet] = state
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected 2 subnets, actual %+v", subnets)
+	}
+	blocked := states[subnet]
+	if blocked.BlockedUntil.IsZero() || blocked.BlockedUntil.Sub(blocked.BlockedAt) != Conf.BlockingTimeout || blocked.Count < Conf.RequestLimit {
+		t.Errorf("expected blocked subnet with its requests, actual %+v", blocked)
+	}
+	if state := states[other]; state.Count != 1 || !state.BlockedUntil.IsZero() || state.Remaining != Conf.RequestLimit-1 {
+		t.Errorf("expected subnet with 1 request, actual %+v", state)
+	}
+
+	if _, err := s.Store.Reset(subnet); err != nil {
+		t.Fatal(err)
+	}
+	if subnets, _ := s.Store.Subnets(); len(subnets) != 1 || subnets[0].Subnet != other {
+		t.Errorf("expected reset subnet not listed, actual %+v", subnets)
+	}
+}
+
+func testConcurrency(t *testing.T, s Subject, limit int) {
+	const goroutines, requests = 100, 10
+	var allowed, failed int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < requests; i++ {
+				decision, err := s.Store.Take(subnet)
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+				} else if decision.Allowed {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if failed != 0 {
+		t.Fatalf("expected no errors, actual %d", failed)
+	}
+	if int(allowed) != limit {
+		t.Errorf("expected exactly %d of %d concurrent requests allowed, actual %d", limit, goroutines*requests, allowed)
+	}
+}
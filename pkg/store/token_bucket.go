@@ -0,0 +1,96 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"math"
+	"time"
+)
+
+// tokenBucketParams are shared by the buckets of all subnets.
+type tokenBucketParams struct {
+	capacity float64
+	// rate of refilling in tokens per second
+	rate float64
+}
+
+// tokenBucket is refilled continuously with RequestLimit tokens per TimeInterval up to the burst capacity,
+// every request takes a token. Unlike fixed windows it does not allow bursts of twice the limit around window boundaries.
+type tokenBucket struct {
+	params    *tokenBucketParams
+	tokens    float64
+	updatedAt time.Time
+	blocked   time.Time
+}
+
+// NewTokenBucketRateLimitStore creates the store with token buckets of conf.Burst capacity,
+// conf.RequestLimit is used as the capacity if the burst is not set.
+func NewTokenBucketRateLimitStore(conf configs.Config, clk clock.Clock) *InMemoryStoreRateLimitStore {
+	return newInMemoryStore(conf, clk, tokenBucketLimiters(conf))
+}
+
+func tokenBucketLimiters(conf configs.Config) limiterFactory {
+	params := &tokenBucketParams{
+		capacity: float64(conf.RequestLimit),
+		rate:     float64(conf.RequestLimit) / conf.TimeInterval.Seconds(),
+	}
+	if conf.Burst > 0 {
+		params.capacity = float64(conf.Burst)
+	}
+	return limiterFactory{
+		algorithm: configs.AlgorithmTokenBucket,
+		newLimiter: func(now time.Time) subnetLimiter {
+			return &tokenBucket{params: params, tokens: params.capacity, updatedAt: now}
+		},
+		restAfter: time.Duration(params.capacity / params.rate * float64(time.Second)),
+	}
+}
+
+func (b *tokenBucket) tokensAt(now time.Time) float64 {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+	return math.Min(b.params.capacity, b.tokens+elapsed*b.params.rate)
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens = b.tokensAt(now)
+	b.updatedAt = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) block(now time.Time, until time.Time) {
+	b.blocked = until
+}
+
+func (b *tokenBucket) blockedUntil(now time.Time) time.Time {
+	if now.Before(b.blocked) {
+		return b.blocked
+	}
+	return time.Time{}
+}
+
+func (b *tokenBucket) quota(now time.Time) Quota {
+	tokens := b.tokensAt(now)
+	untilFull := time.Duration((b.params.capacity - tokens) / b.params.rate * float64(time.Second))
+	return Quota{
+		Limit:     int(b.params.capacity),
+		Remaining: int(tokens),
+		ResetAt:   now.Add(untilFull),
+	}
+}
+
+func (b *tokenBucket) state() limiterState {
+	return limiterState{Tokens: b.tokens, UpdatedAt: b.updatedAt, BlockedUntil: b.blocked}
+}
+
+func (b *tokenBucket) restore(state limiterState) {
+	b.tokens = math.Min(b.params.capacity, state.Tokens)
+	b.updatedAt = state.UpdatedAt
+	b.blocked = state.BlockedUntil
+}
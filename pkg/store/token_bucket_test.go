@@ -0,0 +1,125 @@
+package store
+
+import (
+	"github.com/asavt7/antibot-developer-trainee/pkg/clock"
+	"github.com/asavt7/antibot-developer-trainee/pkg/configs"
+	"testing"
+	"time"
+)
+
+func newTestTokenBucket(conf configs.Config, now time.Time) *tokenBucket {
+	return NewTokenBucketRateLimitStore(conf, clock.New()).newLimiter(now).(*tokenBucket)
+}
+
+func TestTokenBucket(t *testing.T) {
+	conf := configs.Config{RequestLimit: 10, TimeInterval: time.Second}
+	start := time.Now()
+
+	t.Run("burst up to capacity", func(t *testing.T) {
+		bucket := newTestTokenBucket(conf, start)
+		for i := 0; i < 10; i++ {
+			if !bucket.allow(start) {
+				t.Fatalf("expected request %d allowed", i+1)
+			}
+		}
+		if bucket.allow(start) {
+			t.Errorf("expected request over capacity denied")
+		}
+		if !bucket.allow(start.Add(100 * time.Millisecond)) {
+			t.Errorf("expected request allowed after refilling one token")
+		}
+		if bucket.allow(start.Add(100 * time.Millisecond)) {
+			t.Errorf("expected request denied, only one token refilled")
+		}
+	})
+
+	t.Run("custom burst", func(t *testing.T) {
+		burstConf := conf
+		burstConf.Burst = 3
+		bucket := newTestTokenBucket(burstConf, start)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if bucket.allow(start) {
+				allowed++
+			}
+		}
+		if allowed != 3 {
+			t.Errorf("expected 3 requests allowed by burst, actual %d", allowed)
+		}
+	})
+
+	t.Run("no burst of twice the limit around window boundary", func(t *testing.T) {
+		bucket := newTestTokenBucket(conf, start)
+		boundary := start.Add(time.Second)
+		allowed := 0
+		// a fixed window of 1 second would allow 10 requests just before and 10 just after the boundary
+		for i := 0; i < 10; i++ {
+			if bucket.allow(boundary.Add(-10 * time.Millisecond)) {
+				allowed++
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if bucket.allow(boundary.Add(10 * time.Millisecond)) {
+				allowed++
+			}
+		}
+		if allowed > 10 {
+			t.Errorf("expected at most 10 requests allowed within 20ms, actual %d", allowed)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		bucket := newTestTokenBucket(conf, start)
+		for i := 0; i < 4; i++ {
+			bucket.allow(start)
+		}
+		quota := bucket.quota(start)
+		if quota.Limit != 10 || quota.Remaining != 6 {
+			t.Errorf("expected 6 of 10 remaining, actual %+v", quota)
+		}
+		if d := quota.ResetAt.Sub(start); d != 400*time.Millisecond {
+			t.Errorf("expected bucket full in 400ms, actual %s", d)
+		}
+	})
+}
+
+func TestTokenBucketRateLimitStore(t *testing.T) {
+	clk := clock.NewFake(testStart)
+	tbStore := NewTokenBucketRateLimitStore(configs.Config{
+		RequestLimit:    2,
+		TimeInterval:    200 * time.Millisecond,
+		BlockingTimeout: 300 * time.Millisecond,
+	}, clk)
+
+	for i := 0; i < 2; i++ {
+		if decision, _ := tbStore.Take(subnet); !decision.Allowed {
+			t.Errorf("expected request %d allowed", i+1)
+		}
+	}
+	if decision, _ := tbStore.Take(subnet); decision.Allowed {
+		t.Errorf("expected blocked after exceeding burst")
+	}
+	if decision, _ := tbStore.Take("other"); !decision.Allowed {
+		t.Errorf("expected other subnet not to be blocked")
+	}
+	quota, _ := tbStore.Status(subnet)
+	if quota.Remaining != 0 || quota.BlockedUntil.IsZero() {
+		t.Errorf("expected blocked quota, actual %+v", quota)
+	}
+
+	clk.Advance(299 * time.Millisecond)
+	if decision, _ := tbStore.Take(subnet); decision.Allowed {
+		t.Errorf("expected blocked right before blocking timeout")
+	}
+	clk.Advance(time.Millisecond)
+	if decision, _ := tbStore.Take(subnet); !decision.Allowed {
+		t.Errorf("expected unblocked after blocking timeout")
+	}
+
+	tbStore.Take(subnet)
+	tbStore.Take(subnet)
+	tbStore.Reset(subnet)
+	if decision, _ := tbStore.Take(subnet); !decision.Allowed {
+		t.Errorf("expected unblocked after resetting")
+	}
+}